@@ -0,0 +1,80 @@
+package ipxe
+
+import (
+	"fmt"
+	"net"
+	"os"
+
+	"inet.af/netaddr"
+)
+
+// ErrAccessDenied is wrapped by the errors returned for clients an ACL does not allow.
+var ErrAccessDenied = fmt.Errorf("access denied: %w", os.ErrPermission)
+
+// ACL controls which clients are served files over TFTP and HTTP.
+// A nil ACL allows every client.
+//
+// Denied HTTP clients get a 403. Denied TFTP clients get an error packet with the reason, with
+// code 2, access violation, from the windowed server, see TFTP.WindowSize. github.com/pin/tftp,
+// which serves the other requests, sends code 1, file not found, for every error.
+type ACL struct {
+	// Allow, when set, holds the only client IPs that are allowed.
+	Allow *netaddr.IPSet
+	// Deny holds client IPs that are refused, even when they are in Allow.
+	Deny *netaddr.IPSet
+	// MACs, when set, are the only MAC addresses that are allowed. Requests must then name
+	// one of them, with a filename prefixed with the MAC address, like aa:bb:cc:dd:ee:ff/ipxe.efi.
+	MACs []net.HardwareAddr
+}
+
+// Check returns an error wrapping ErrAccessDenied when a client with ip, requesting a file
+// for mac, is not allowed. mac is nil for requests that do not name a MAC address.
+func (a *ACL) Check(ip netaddr.IP, mac net.HardwareAddr) error {
+	if a == nil {
+		return nil
+	}
+	ip = ip.Unmap()
+	if a.Deny != nil && a.Deny.Contains(ip) {
+		return fmt.Errorf("%v is denied: %w", ip, ErrAccessDenied)
+	}
+	if a.Allow != nil && !a.Allow.Contains(ip) {
+		return fmt.Errorf("%v is not allowed: %w", ip, ErrAccessDenied)
+	}
+	if len(a.MACs) == 0 {
+		return nil
+	}
+	if mac == nil {
+		return fmt.Errorf("request without a MAC address: %w", ErrAccessDenied)
+	}
+	for _, m := range a.MACs {
+		if m.String() == mac.String() {
+			return nil
+		}
+	}
+	return fmt.Errorf("MAC address %v is not allowed: %w", mac, ErrAccessDenied)
+}
+
+// ParseIPSet parses IPs, IP ranges like 10.0.0.1-10.0.0.9 and CIDR prefixes into an IPSet.
+// It returns nil when there are no rules.
+func ParseIPSet(rules []string) (*netaddr.IPSet, error) {
+	if len(rules) == 0 {
+		return nil, nil
+	}
+	var b netaddr.IPSetBuilder
+	for _, r := range rules {
+		if p, err := netaddr.ParseIPPrefix(r); err == nil {
+			b.AddPrefix(p.Masked())
+			continue
+		}
+		if rng, err := netaddr.ParseIPRange(r); err == nil {
+			b.AddRange(rng)
+			continue
+		}
+		ip, err := netaddr.ParseIP(r)
+		if err != nil {
+			return nil, fmt.Errorf("invalid IP, range or CIDR %q", r)
+		}
+		b.Add(ip)
+	}
+	return b.IPSet()
+}
@@ -0,0 +1,139 @@
+package ipxe
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-logr/logr"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"inet.af/netaddr"
+)
+
+func TestACL_Check(t *testing.T) {
+	allow, err := ParseIPSet([]string{"192.168.2.0/24", "10.0.0.1-10.0.0.9"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	deny, err := ParseIPSet([]string{"192.168.2.66"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mac, _ := net.ParseMAC("aa:bb:cc:dd:ee:ff")
+	other, _ := net.ParseMAC("00:11:22:33:44:55")
+	tests := []struct {
+		name    string
+		acl     *ACL
+		ip      string
+		mac     net.HardwareAddr
+		allowed bool
+	}{
+		{name: "nil acl", ip: "172.16.0.1", allowed: true},
+		{name: "allowed prefix", acl: &ACL{Allow: allow}, ip: "192.168.2.34", allowed: true},
+		{name: "allowed range", acl: &ACL{Allow: allow}, ip: "10.0.0.5", allowed: true},
+		{name: "mapped ipv4", acl: &ACL{Allow: allow}, ip: "::ffff:192.168.2.34", allowed: true},
+		{name: "not allowed", acl: &ACL{Allow: allow}, ip: "10.0.0.10"},
+		{name: "denied", acl: &ACL{Deny: deny}, ip: "192.168.2.66"},
+		{name: "deny wins over allow", acl: &ACL{Allow: allow, Deny: deny}, ip: "192.168.2.66"},
+		{name: "allowed mac", acl: &ACL{Allow: allow, MACs: []net.HardwareAddr{mac}}, ip: "192.168.2.34", mac: mac, allowed: true},
+		{name: "other mac", acl: &ACL{MACs: []net.HardwareAddr{mac}}, ip: "192.168.2.34", mac: other},
+		{name: "no mac", acl: &ACL{MACs: []net.HardwareAddr{mac}}, ip: "192.168.2.34"},
+		{name: "allowed mac from a denied ip", acl: &ACL{Deny: deny, MACs: []net.HardwareAddr{mac}}, ip: "192.168.2.66", mac: mac},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.acl.Check(netaddr.MustParseIP(tt.ip), tt.mac)
+			if tt.allowed && err != nil {
+				t.Fatalf("expected %v to be allowed, got: %v", tt.ip, err)
+			}
+			if !tt.allowed && !errors.Is(err, ErrAccessDenied) {
+				t.Fatalf("expected %v to be denied, got: %v", tt.ip, err)
+			}
+		})
+	}
+}
+
+func TestParseIPSet(t *testing.T) {
+	if s, err := ParseIPSet(nil); s != nil || err != nil {
+		t.Fatalf("got %v, %v, want nil, nil", s, err)
+	}
+	if _, err := ParseIPSet([]string{"192.168.2.0/33"}); err == nil {
+		t.Fatal("expected an error")
+	}
+	s, err := ParseIPSet([]string{"192.168.2.7/24", "2001:db8::1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for ip, want := range map[string]bool{"192.168.2.1": true, "192.168.3.1": false, "2001:db8::1": true} {
+		if got := s.Contains(netaddr.MustParseIP(ip)); got != want {
+			t.Fatalf("%v, got: %v, want: %v", ip, got, want)
+		}
+	}
+}
+
+func TestHandlers_ACL(t *testing.T) {
+	deny, err := ParseIPSet([]string{"127.0.0.0/8", "192.0.2.0/24"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	acl := &ACL{Deny: deny}
+	files := MapSource{"ipxe.efi": []byte("ipxe")}
+	tftpDenied := testutil.ToFloat64(deniedTotal.WithLabelValues(protocolTFTP))
+	httpDenied := testutil.ToFloat64(deniedTotal.WithLabelValues(protocolHTTP))
+
+	ht := HandleTFTP{Log: logr.Discard(), Files: files, ACL: acl}
+	rf := &fakeReaderFrom{addr: net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9999}, content: make([]byte, 4)}
+	if err := ht.ReadHandler("ipxe.efi", rf); !errors.Is(err, ErrAccessDenied) {
+		t.Fatalf("error mismatch, got: %v, want: %v", err, ErrAccessDenied)
+	}
+
+	hh := HandleHTTP{Log: logr.Discard(), Files: files, ACL: acl}
+	w := httptest.NewRecorder()
+	hh.Handler(w, httptest.NewRequest(http.MethodGet, "/ipxe.efi", nil))
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("got status %v, want %v", w.Code, http.StatusForbidden)
+	}
+
+	if got := testutil.ToFloat64(deniedTotal.WithLabelValues(protocolTFTP)) - tftpDenied; got != 1 {
+		t.Fatalf("tftp denied, got: %v, want: 1", got)
+	}
+	if got := testutil.ToFloat64(deniedTotal.WithLabelValues(protocolHTTP)) - httpDenied; got != 1 {
+		t.Fatalf("http denied, got: %v, want: 1", got)
+	}
+	if got := testutil.ToFloat64(requestsTotal.WithLabelValues(protocolHTTP, "", outcomeDenied)); got < 1 {
+		t.Fatal("expected the denied request to be counted without a filename")
+	}
+}
+
+func TestHandleTFTP_ACLErrorCode(t *testing.T) {
+	deny, err := ParseIPSet([]string{"127.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		cfg  TFTP
+		opts map[string]string
+		want string
+	}{
+		{name: "windowed", cfg: TFTP{WindowSize: 16}, opts: map[string]string{"windowsize": "16"}, want: "code=2"},
+		// pin/tftp sends code 1 for every error.
+		{name: "pin/tftp", want: "code=1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := HandleTFTP{Log: logr.Discard(), Files: MapSource{"ipxe.efi": []byte("ipxe")}, ACL: &ACL{Deny: deny}}
+			addr := serveTestTFTPHandler(t, h, tt.cfg)
+			_, _, err := tftpGet(addr, "ipxe.efi", tt.opts, 0)
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+			if !strings.HasPrefix(err.Error(), tt.want) || !strings.Contains(err.Error(), "access denied") {
+				t.Fatalf("got: %v, want: %v and the reason", err, tt.want)
+			}
+		})
+	}
+}
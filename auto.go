@@ -0,0 +1,232 @@
+package ipxe
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	"inet.af/netaddr"
+)
+
+// AutoFile is a virtual file name that resolves to the iPXE binary for the architecture of the
+// machine requesting it. It lets DHCP servers hand every machine the same boot filename.
+// HTTP responses for it are marked private and must be revalidated, as they differ per machine.
+const AutoFile = "auto.ipxe-binary"
+
+// defaultArchTTL is how long an ArchCache remembers the architecture of a machine by default.
+const defaultArchTTL = time.Hour
+
+// Client holds what is known about the machine requesting a file, beyond its MAC address.
+// HandleTFTP and HandleHTTP add it to the context passed to MACFileSource.OpenFor.
+type Client struct {
+	// IP is the IP address the request came from.
+	IP netaddr.IP
+	// UserAgent is the User-Agent header of HTTP requests.
+	UserAgent string
+}
+
+type clientKey struct{}
+
+// WithClient returns a copy of ctx carrying c.
+func WithClient(ctx context.Context, c Client) context.Context {
+	return context.WithValue(ctx, clientKey{}, c)
+}
+
+// ClientFromContext returns the Client carried by ctx, or the zero Client.
+func ClientFromContext(ctx context.Context) Client {
+	c, _ := ctx.Value(clientKey{}).(Client)
+	return c
+}
+
+// ArchCache remembers the architecture of machines, as reported in their DHCP requests.
+// HandleProxyDHCP records into it and AutoSource reads from it.
+type ArchCache struct {
+	// TTL is how long an architecture is remembered. Defaults to one hour.
+	TTL time.Duration
+
+	mu    sync.Mutex
+	byMAC map[string]archEntry
+	byIP  map[netaddr.IP]archEntry
+}
+
+type archEntry struct {
+	arch    Arch
+	expires time.Time
+}
+
+// Record remembers arch for the machine with the given MAC address and, when it is not the zero IP, IP address.
+func (a *ArchCache) Record(mac net.HardwareAddr, ip netaddr.IP, arch Arch) {
+	ttl := a.TTL
+	if ttl <= 0 {
+		ttl = defaultArchTTL
+	}
+	now := time.Now()
+	e := archEntry{arch: arch, expires: now.Add(ttl)}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.byMAC == nil {
+		a.byMAC = make(map[string]archEntry)
+		a.byIP = make(map[netaddr.IP]archEntry)
+	}
+	for k, v := range a.byMAC {
+		if now.After(v.expires) {
+			delete(a.byMAC, k)
+		}
+	}
+	for k, v := range a.byIP {
+		if now.After(v.expires) {
+			delete(a.byIP, k)
+		}
+	}
+	if len(mac) > 0 {
+		a.byMAC[mac.String()] = e
+	}
+	if !ip.IsZero() && !ip.IsUnspecified() {
+		a.byIP[ip] = e
+	}
+}
+
+// Lookup returns the architecture recorded for the machine, by MAC address first and then by IP address.
+func (a *ArchCache) Lookup(mac net.HardwareAddr, ip netaddr.IP) (Arch, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	now := time.Now()
+	if e, ok := a.byMAC[mac.String()]; ok && len(mac) > 0 && now.Before(e.expires) {
+		return e.arch, true
+	}
+	if e, ok := a.byIP[ip]; ok && !ip.IsZero() && now.Before(e.expires) {
+		return e.arch, true
+	}
+	return 0, false
+}
+
+// userAgentArchs map substrings of HTTP User-Agent headers to architectures, in the order they are checked.
+// UEFI HTTP Boot firmware does not always include its architecture, "UefiHttpBoot/1.0" for example.
+var userAgentArchs = []struct {
+	substr string
+	arch   Arch
+}{
+	{"aarch64", ArchARM64EFI},
+	{"arm64", ArchARM64EFI},
+	{"x86_64", ArchX64EFI},
+	{"x86-64", ArchX64EFI},
+	{"amd64", ArchX64EFI},
+	{"x64", ArchX64EFI},
+}
+
+// archFromUserAgent returns the architecture named in an HTTP User-Agent header.
+func archFromUserAgent(ua string) (Arch, bool) {
+	ua = strings.ToLower(ua)
+	for _, u := range userAgentArchs {
+		if strings.Contains(ua, u.substr) {
+			return u.arch, true
+		}
+	}
+	return 0, false
+}
+
+// AutoSource is a MACFileSource that serves AutoFile. It resolves AutoFile to a file in Source,
+// using, in order:
+//
+//  1. the file in Overrides for the MAC address of the machine,
+//  2. the architecture recorded in Archs by a previous proxyDHCP exchange with the machine,
+//  3. the architecture named in the User-Agent of an HTTP request,
+//  4. Default.
+//
+// All other files are opened from Source unchanged.
+type AutoSource struct {
+	// Source is the FileSource to open files from.
+	Source FileSource
+	// Archs holds the architectures recorded from proxyDHCP exchanges.
+	Archs *ArchCache
+	// Overrides are the file names to serve for AutoFile, by MAC address in the format
+	// returned by net.HardwareAddr.String.
+	Overrides map[string]string
+	// Default is the file served when the architecture of a machine is unknown.
+	// When empty, such requests fail with a file not found error.
+	Default string
+	// Log is the logger to use.
+	Log logr.Logger
+}
+
+// Open implements FileSource.
+func (a *AutoSource) Open(name string) (*File, error) {
+	return a.OpenFor(context.Background(), name, nil)
+}
+
+// List implements FileLister when Source does. AutoFile is not listed.
+func (a *AutoSource) List() ([]string, error) {
+	l, ok := sourceOrDefault(a.Source).(FileLister)
+	if !ok {
+		return nil, errNotLister(a.Source)
+	}
+	return l.List()
+}
+
+// OpenFor implements MACFileSource.
+func (a *AutoSource) OpenFor(ctx context.Context, name string, mac net.HardwareAddr) (*File, error) {
+	if name != AutoFile {
+		return openFor(ctx, a.Source, name, mac)
+	}
+	resolved, via := a.resolve(ctx, mac)
+	if resolved == "" {
+		return nil, fmt.Errorf("%q: architecture of %v unknown: %w", name, mac, os.ErrNotExist)
+	}
+	orDiscard(a.Log).V(1).Info("resolved auto file", "mac", mac.String(), "file", resolved, "via", via)
+	return openFor(ctx, a.Source, resolved, mac)
+}
+
+// resolve returns the file name AutoFile resolves to for the machine, and what it was resolved by.
+func (a *AutoSource) resolve(ctx context.Context, mac net.HardwareAddr) (name, via string) {
+	if len(mac) > 0 {
+		if name, ok := a.Overrides[mac.String()]; ok {
+			return name, "override"
+		}
+	}
+	c := ClientFromContext(ctx)
+	if a.Archs != nil {
+		if arch, ok := a.Archs.Lookup(mac, c.IP); ok {
+			if name, ok := arch.BootFile(); ok {
+				return name, "dhcp"
+			}
+		}
+	}
+	if arch, ok := archFromUserAgent(c.UserAgent); ok {
+		if name, ok := arch.BootFile(); ok {
+			return name, "user-agent"
+		}
+	}
+	return a.Default, "default"
+}
+
+// LoadAutoOverrides reads AutoSource.Overrides from a JSON file containing an object
+// of MAC addresses to file names. For example:
+//
+//	{"aa:bb:cc:dd:ee:ff": "snp.efi"}
+func LoadAutoOverrides(file string) (map[string]string, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	raw := map[string]string{}
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return nil, fmt.Errorf("parsing %q: %w", file, err)
+	}
+	m := make(map[string]string, len(raw))
+	for k, v := range raw {
+		mac, err := net.ParseMAC(k)
+		if err != nil {
+			return nil, fmt.Errorf("parsing %q: %w", file, err)
+		}
+		m[mac.String()] = v
+	}
+	return m, nil
+}
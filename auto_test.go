@@ -0,0 +1,153 @@
+package ipxe
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/google/go-cmp/cmp"
+	"inet.af/netaddr"
+)
+
+func TestAutoSource_OpenFor(t *testing.T) {
+	src := MapSource{"undionly.kpxe": []byte("bios"), "ipxe.efi": []byte("x86_64"), "snp.efi": []byte("arm64")}
+	mac, _ := net.ParseMAC("00:01:02:03:04:05")
+	other, _ := net.ParseMAC("00:01:02:03:04:06")
+	archs := &ArchCache{}
+	archs.Record(mac, netaddr.IP{}, ArchARM64EFI)
+	archs.Record(nil, netaddr.MustParseIP("192.168.1.20"), ArchX86BIOS)
+
+	tests := []struct {
+		name      string
+		file      string
+		mac       net.HardwareAddr
+		client    Client
+		overrides map[string]string
+		def       string
+		want      string
+		wantErr   error
+	}{
+		{name: "not auto", file: "ipxe.efi", mac: mac, want: "x86_64"},
+		{name: "override", file: AutoFile, mac: mac, overrides: map[string]string{mac.String(): "ipxe.efi"}, want: "x86_64"},
+		{name: "dhcp by mac", file: AutoFile, mac: mac, want: "arm64"},
+		{name: "dhcp by ip", file: AutoFile, client: Client{IP: netaddr.MustParseIP("192.168.1.20")}, want: "bios"},
+		{name: "dhcp before user agent", file: AutoFile, mac: mac, client: Client{UserAgent: "UefiHttpBoot/1.0 (x86_64)"}, want: "arm64"},
+		{name: "user agent", file: AutoFile, mac: other, client: Client{UserAgent: "UefiHttpBoot/1.0 (AArch64)"}, want: "arm64"},
+		{name: "default", file: AutoFile, mac: other, client: Client{UserAgent: "UefiHttpBoot/1.0"}, def: "ipxe.efi", want: "x86_64"},
+		{name: "unknown", file: AutoFile, mac: other, wantErr: os.ErrNotExist},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := &AutoSource{Source: src, Archs: archs, Overrides: tt.overrides, Default: tt.def, Log: logr.Discard()}
+			f, err := a.OpenFor(WithClient(context.Background(), tt.client), tt.file, tt.mac)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("error mismatch, got: %v, want: %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			got, err := ioutil.ReadAll(f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(string(got), tt.want); diff != "" {
+				t.Fatal(diff)
+			}
+		})
+	}
+}
+
+func TestArchCache_Expiry(t *testing.T) {
+	mac, _ := net.ParseMAC("00:01:02:03:04:05")
+	ip := netaddr.MustParseIP("192.168.1.20")
+	a := &ArchCache{TTL: time.Millisecond}
+	a.Record(mac, ip, ArchX64EFI)
+	if got, ok := a.Lookup(mac, netaddr.IP{}); !ok || got != ArchX64EFI {
+		t.Fatalf("got: %v %v, want: %v true", got, ok, ArchX64EFI)
+	}
+	time.Sleep(5 * time.Millisecond)
+	if _, ok := a.Lookup(mac, ip); ok {
+		t.Fatal("expected the architecture to have expired")
+	}
+}
+
+func TestHandleProxyDHCP_RecordsArch(t *testing.T) {
+	archs := &ArchCache{}
+	h := &HandleProxyDHCP{Log: logr.Discard(), TFTPAddr: netaddr.MustParseIPPort("127.0.0.1:69"), Archs: archs}
+	req := testDHCPPacket(dhcpRequest, map[byte][]byte{optVendorClass: []byte("PXEClient:Arch:00011:UNDI:003000"), optClientArch: archOpt(ArchARM64EFI)})
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	src := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: conn.LocalAddr().(*net.UDPAddr).Port}
+	if err := h.handle(conn, src, req.marshal(), PXEPort); err != nil {
+		t.Fatal(err)
+	}
+	if got, ok := archs.Lookup(req.mac(), netaddr.IP{}); !ok || got != ArchARM64EFI {
+		t.Fatalf("by mac, got: %v %v, want: %v true", got, ok, ArchARM64EFI)
+	}
+	if got, ok := archs.Lookup(nil, netaddr.MustParseIP("127.0.0.1")); !ok || got != ArchARM64EFI {
+		t.Fatalf("by ip, got: %v %v, want: %v true", got, ok, ArchARM64EFI)
+	}
+
+	// the request of a client for the IP offered by the DHCP server is not answered, its
+	// architecture is recorded by the requested IP.
+	archs = &ArchCache{}
+	h.Archs = archs
+	req = testDHCPPacket(dhcpRequest, map[byte][]byte{
+		optVendorClass: []byte("HTTPClient:Arch:00016:UNDI:003001"),
+		optClientArch:  archOpt(ArchX64EFIHTTP),
+		optServerID:    {192, 168, 2, 1},
+		optRequestedIP: {192, 168, 2, 50},
+	})
+	broadcast := &net.UDPAddr{IP: net.IPv4zero, Port: dhcpClientPort}
+	if err := h.handle(nil, broadcast, req.marshal(), ProxyDHCPPort); !errors.Is(err, errOtherServer) {
+		t.Fatalf("error mismatch, got: %v, want: %v", err, errOtherServer)
+	}
+	if got, ok := archs.Lookup(nil, netaddr.MustParseIP("192.168.2.50")); !ok || got != ArchX64EFIHTTP {
+		t.Fatalf("by requested ip, got: %v %v, want: %v true", got, ok, ArchX64EFIHTTP)
+	}
+}
+
+func TestHandleHTTP_HandlerAuto(t *testing.T) {
+	h := HandleHTTP{Log: logr.Discard(), Files: &AutoSource{Source: MapSource{"snp.efi": []byte("arm64")}, Archs: &ArchCache{}}}
+	req := httptest.NewRequest(http.MethodGet, "/"+AutoFile, nil)
+	req.Header.Set("User-Agent", "UefiHttpBoot/1.0 (arm64)")
+	w := httptest.NewRecorder()
+	h.Handler(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %v, want %v", w.Code, http.StatusOK)
+	}
+	if diff := cmp.Diff(w.Body.String(), "arm64"); diff != "" {
+		t.Fatal(diff)
+	}
+	if got := w.Header().Get("Cache-Control"); got != "private, no-cache" {
+		t.Fatalf("got Cache-Control %q, want %q", got, "private, no-cache")
+	}
+	if got := w.Header().Get("Vary"); got != "User-Agent" {
+		t.Fatalf("got Vary %q, want %q", got, "User-Agent")
+	}
+}
+
+func TestLoadAutoOverrides(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "overrides.json")
+	if err := ioutil.WriteFile(name, []byte(`{"AA-BB-CC-DD-EE-FF": "snp.efi"}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	got, err := LoadAutoOverrides(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(got, map[string]string{"aa:bb:cc:dd:ee:ff": "snp.efi"}); diff != "" {
+		t.Fatal(diff)
+	}
+}
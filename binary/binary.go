@@ -1,8 +1,11 @@
 // Package binary holds the embedded ipxe binaries.
 package binary
 
-// embed lib for embedding the iPXE binaries.
-import _ "embed"
+import (
+	// embed lib for embedding the iPXE binaries.
+	_ "embed"
+	"strings"
+)
 
 // IpxeEFI is the UEFI iPXE binary for x86 architectures.
 //go:embed ipxe.efi
@@ -16,6 +19,20 @@ var Undionly []byte
 //go:embed snp.efi
 var SNP []byte
 
+// ipxeCommit is the iPXE git commit the binaries were built from.
+//go:embed script/ipxe.commit
+var ipxeCommit string
+
+// IPXECommit is the upstream iPXE git commit the binaries in Files were built from.
+var IPXECommit = strings.TrimSpace(ipxeCommit)
+
+// Archs are the target architectures of the binaries in Files, named after the iPXE build directories.
+var Archs = map[string]string{
+	"undionly.kpxe": "i386-pcbios",
+	"ipxe.efi":      "x86_64-efi",
+	"snp.efi":       "arm64-efi",
+}
+
 // Files are the ipxe binaries to be embedded.
 var Files = map[string][]byte{
 	"undionly.kpxe": Undionly,
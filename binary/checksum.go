@@ -0,0 +1,51 @@
+package binary
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+
+	// embed lib for embedding the expected iPXE binary checksums.
+	_ "embed"
+)
+
+// sha512sums is the output of sha512sum for the iPXE binaries and the files used to build them.
+//go:embed script/sha512sum.txt
+var sha512sums []byte
+
+// Checksums are the expected hex encoded SHA-512 digests of the iPXE binaries in Files, by file name.
+var Checksums = func() map[string]string {
+	c, err := ParseChecksums(bytes.NewReader(sha512sums))
+	if err != nil {
+		panic(fmt.Sprintf("parsing embedded script/sha512sum.txt: %v", err))
+	}
+	return c
+}()
+
+// ParseChecksums parses the output of sha512sum (or any other sha*sum tool) into
+// a map of file names to hex encoded digests. Only files in the top level directory
+// are returned, their names are cleaned, so "./ipxe.efi" becomes "ipxe.efi".
+func ParseChecksums(r io.Reader) (map[string]string, error) {
+	c := map[string]string{}
+	s := bufio.NewScanner(r)
+	for line := 1; s.Scan(); line++ {
+		text := strings.TrimSpace(s.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("line %d: expected a digest and a file name, got %q", line, text)
+		}
+		// sha512sum prefixes the file name with "*" in binary mode.
+		name := path.Clean(strings.TrimPrefix(fields[1], "*"))
+		if path.Dir(name) != "." {
+			continue
+		}
+		c[name] = strings.ToLower(fields[0])
+	}
+	return c, s.Err()
+}
@@ -0,0 +1,53 @@
+package binary
+
+import (
+	"crypto/sha512"
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestChecksums(t *testing.T) {
+	for name, content := range Files {
+		sum := sha512.Sum512(content)
+		if diff := cmp.Diff(Checksums[name], hex.EncodeToString(sum[:])); diff != "" {
+			t.Errorf("%v: %v", name, diff)
+		}
+	}
+}
+
+func TestParseChecksums(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    map[string]string
+		wantErr bool
+	}{
+		{
+			name:  "success",
+			input: "ABC  ./ipxe.efi\ndef *snp.efi\n\n123  ./script/embed.ipxe\n",
+			want:  map[string]string{"ipxe.efi": "abc", "snp.efi": "def"},
+		},
+		{
+			name:    "malformed",
+			input:   "abc\n",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseChecksums(strings.NewReader(tt.input))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error mismatch, got: %v, wantErr: %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if diff := cmp.Diff(got, tt.want); diff != "" {
+				t.Fatal(diff)
+			}
+		})
+	}
+}
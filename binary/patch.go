@@ -0,0 +1,66 @@
+package binary
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+)
+
+var (
+	// patchBegin and patchEnd mark the region of script/embed-patchable.ipxe that is reserved for runtime patching.
+	patchBegin = []byte("#ipxe-patch-begin\n")
+	patchEnd   = []byte("#ipxe-patch-end\n")
+	// shebang is the header every iPXE script starts with.
+	shebang = []byte("#!ipxe")
+)
+
+// ErrNoPatchRegion is returned by Patch when a binary does not contain a patchable embedded script region.
+// Only binaries built from script/embed-patchable.ipxe (make binary/patchable) contain one, the embedded ones do not.
+// Compressed binaries never do, undionly.kpxe is compressed by the iPXE build, so BIOS clients always run its own embedded script.
+var ErrNoPatchRegion = errors.New("binary has no patchable embedded script region")
+
+// Patch returns a copy of content with the reserved region of its embedded script
+// (see script/embed-patchable.ipxe) replaced by script.
+// The "#!ipxe" header of script is optional, the region always follows one.
+// The region has a fixed size, the remainder of it is filled with blank lines.
+func Patch(content, script []byte) ([]byte, error) {
+	begin, end, ok := patchRegion(content)
+	if !ok {
+		return nil, ErrNoPatchRegion
+	}
+
+	script = bytes.TrimPrefix(script, shebang)
+	if len(script) > 0 && script[len(script)-1] != '\n' {
+		script = append(script[:len(script):len(script)], '\n')
+	}
+	if size := end - begin; len(script) > size {
+		return nil, fmt.Errorf("script is %d bytes, the patchable region is only %d bytes", len(script), size)
+	}
+
+	patched := make([]byte, len(content))
+	copy(patched, content)
+	n := copy(patched[begin:end], script)
+	for i := begin + n; i < end; i++ {
+		patched[i] = '\n'
+	}
+	return patched, nil
+}
+
+// HasPatchRegion reports whether content contains a patchable embedded script region.
+func HasPatchRegion(content []byte) bool {
+	_, _, ok := patchRegion(content)
+	return ok
+}
+
+// patchRegion returns the offsets of the patchable region of content, markers included.
+func patchRegion(content []byte) (begin, end int, ok bool) {
+	begin = bytes.Index(content, patchBegin)
+	if begin == -1 {
+		return 0, 0, false
+	}
+	end = bytes.Index(content[begin:], patchEnd)
+	if end == -1 {
+		return 0, 0, false
+	}
+	return begin, begin + end + len(patchEnd), true
+}
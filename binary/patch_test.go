@@ -0,0 +1,86 @@
+package binary
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestPatch(t *testing.T) {
+	region := "#ipxe-patch-begin\nautoboot\n#####\n#ipxe-patch-end\n"
+	content := []byte("MZ\x00\x01#!ipxe\n" + region + "\x00\x02")
+	tests := []struct {
+		name    string
+		content []byte
+		script  []byte
+		want    []byte
+		wantErr error
+	}{
+		{
+			name:    "success",
+			content: content,
+			script:  []byte("#!ipxe\nexit\n"),
+			want:    []byte("MZ\x00\x01#!ipxe\n\nexit\n" + string(bytes.Repeat([]byte("\n"), len(region)-len("\nexit\n"))) + "\x00\x02"),
+		},
+		{
+			name:    "no trailing newline",
+			content: content,
+			script:  []byte("exit"),
+			want:    []byte("MZ\x00\x01#!ipxe\nexit\n" + string(bytes.Repeat([]byte("\n"), len(region)-len("exit\n"))) + "\x00\x02"),
+		},
+		{
+			name:    "no region",
+			content: []byte("compressed"),
+			script:  []byte("exit"),
+			wantErr: ErrNoPatchRegion,
+		},
+		{
+			name:    "script too big",
+			content: content,
+			script:  bytes.Repeat([]byte("a"), len(region)+1),
+			wantErr: errors.New("script is 51 bytes, the patchable region is only 49 bytes"),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Patch(tt.content, tt.script)
+			if tt.wantErr != nil {
+				if err == nil || (!errors.Is(err, tt.wantErr) && err.Error() != tt.wantErr.Error()) {
+					t.Fatalf("error mismatch, got: %v, want: %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(string(got), string(tt.want)); diff != "" {
+				t.Fatal(diff)
+			}
+			if len(got) != len(tt.content) {
+				t.Fatalf("patched binary size changed, got: %v, want: %v", len(got), len(tt.content))
+			}
+		})
+	}
+}
+
+func TestHasPatchRegion(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    bool
+	}{
+		{name: "region", content: "MZ#!ipxe\n#ipxe-patch-begin\nautoboot\n#ipxe-patch-end\n", want: true},
+		{name: "no end marker", content: "MZ#!ipxe\n#ipxe-patch-begin\nautoboot\n"},
+		{name: "end before begin", content: "MZ#ipxe-patch-end\n#ipxe-patch-begin\n"},
+		{name: "none", content: "compressed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := HasPatchRegion([]byte(tt.content)); got != tt.want {
+				t.Fatalf("got: %v, want: %v", got, tt.want)
+			}
+		})
+	}
+}
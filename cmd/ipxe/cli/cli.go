@@ -4,12 +4,26 @@ import (
 	"context"
 	"flag"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/go-logr/logr"
 	"github.com/go-logr/zapr"
 	"github.com/imdario/mergo"
 	"github.com/jacobweinstock/ipxe"
+	"github.com/jacobweinstock/ipxe/binary"
+	"github.com/peterbourgon/ff/v3"
 	"github.com/peterbourgon/ff/v3/ffcli"
+	"github.com/peterbourgon/ff/v3/ffyaml"
 	"github.com/pkg/errors"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
@@ -18,12 +32,122 @@ import (
 
 const rootCLI = "ipxe"
 
+// envVarPrefix is the prefix of the environment variables flags are read from, for example
+// IPXE_TFTP_ADDR for -tftp-addr.
+const envVarPrefix = "IPXE"
+
 // Config is the configuration for the ipxe CLI.
 type Config struct {
 	TFTPAddr string
 	HTTPAddr string
 	LogLevel string
 	Log      logr.Logger
+	// TFTPDisabled turns the TFTP server off.
+	TFTPDisabled bool
+	// HTTPDisabled turns the HTTP server off.
+	HTTPDisabled bool
+	// TFTPTimeout is the timeout for receiving a TFTP acknowledgement.
+	TFTPTimeout time.Duration
+	// TFTPMaxRetries is the maximum number of attempts to transmit a TFTP packet.
+	TFTPMaxRetries int
+	// TFTPBackoff is the TFTP retransmission backoff policy, see ipxe.ParseBackoff.
+	TFTPBackoff string
+	// TFTPBlockSize is the maximum TFTP block size negotiated with clients.
+	TFTPBlockSize int
+	// TFTPWindowSize is the maximum RFC 7440 TFTP window size negotiated with clients.
+	TFTPWindowSize int
+	// TFTPSinglePort serves all TFTP transfers from the listen port.
+	TFTPSinglePort bool
+	// TFTPUploadDir is the directory TFTP uploads are written to. When empty uploads are refused.
+	TFTPUploadDir string
+	// TFTPUploadMaxSize is the maximum size of a single TFTP upload in bytes, 0 means no limit.
+	TFTPUploadMaxSize int64
+	// TFTPUploadQuota is the maximum total size of the TFTP uploads of a client in bytes, 0 means no limit.
+	TFTPUploadQuota int64
+	// TFTPUploadPattern is a regular expression the names of TFTP uploads must match.
+	TFTPUploadPattern string
+	// TFTPMaxTransfers is the maximum number of concurrent TFTP transfers, 0 means no limit.
+	TFTPMaxTransfers int
+	// TFTPMaxClientTransfers is the maximum number of concurrent TFTP transfers of a client, 0 means no limit.
+	TFTPMaxClientTransfers int
+	// TFTPRate is the maximum number of TFTP requests per second, 0 means no limit.
+	TFTPRate float64
+	// TFTPBurst is the number of TFTP requests allowed at once above TFTPRate, 0 means TFTPRate rounded up.
+	TFTPBurst int
+	// TFTPClientRate is the maximum number of TFTP requests per second of a client, 0 means no limit.
+	TFTPClientRate float64
+	// TFTPClientBurst is the number of TFTP requests of a client allowed at once above TFTPClientRate, 0 means TFTPClientRate rounded up.
+	TFTPClientBurst int
+	// TFTPQueueTimeout is how long TFTP requests over the limits wait before they are refused.
+	TFTPQueueTimeout time.Duration
+	// HTTPReadTimeout is the maximum duration for reading an entire HTTP request.
+	HTTPReadTimeout time.Duration
+	// HTTPReadHeaderTimeout is the maximum duration for reading HTTP request headers.
+	HTTPReadHeaderTimeout time.Duration
+	// HTTPWriteTimeout is the maximum duration for writing an HTTP response.
+	HTTPWriteTimeout time.Duration
+	// HTTPIdleTimeout is the maximum duration to wait for the next request on a keep-alive HTTP connection.
+	HTTPIdleTimeout time.Duration
+	// HTTPMaxConns is the maximum number of concurrent HTTP connections, 0 means no limit.
+	HTTPMaxConns int
+	// HTTPMaxHeaderBytes is the maximum size of HTTP request headers, 0 means the net/http default.
+	HTTPMaxHeaderBytes int
+	// HTTPMaxTransfers is the maximum number of concurrent HTTP transfers, 0 means no limit.
+	HTTPMaxTransfers int
+	// HTTPMaxClientTransfers is the maximum number of concurrent HTTP transfers of a client, 0 means no limit.
+	HTTPMaxClientTransfers int
+	// HTTPRate is the maximum number of HTTP requests per second, 0 means no limit.
+	HTTPRate float64
+	// HTTPBurst is the number of HTTP requests allowed at once above HTTPRate, 0 means HTTPRate rounded up.
+	HTTPBurst int
+	// HTTPClientRate is the maximum number of HTTP requests per second of a client, 0 means no limit.
+	HTTPClientRate float64
+	// HTTPClientBurst is the number of HTTP requests of a client allowed at once above HTTPClientRate, 0 means HTTPClientRate rounded up.
+	HTTPClientBurst int
+	// HTTPRetryAfter is how long HTTP clients refused for too many transfers in progress are told to wait.
+	HTTPRetryAfter time.Duration
+	// DrainTimeout is how long a shutdown waits for transfers in progress to finish before aborting them.
+	DrainTimeout time.Duration
+	// MetricsAddr is the IP and port to serve Prometheus metrics on. When empty metrics are not served.
+	MetricsAddr string
+	// FilesDir is a directory of files to serve. When empty the embedded iPXE binaries are served.
+	FilesDir string
+	// FilesDirOnly disables overlaying FilesDir on top of the embedded iPXE binaries.
+	FilesDirOnly bool
+	// EmbeddedScript is the path to an iPXE script to patch into the served iPXE binaries.
+	EmbeddedScript string
+	// MACScripts is the path to a JSON file of MAC addresses to iPXE scripts to patch into the served iPXE binaries.
+	MACScripts string
+	// Verify is what to do when a served file does not match its expected checksum: enforce, warn or off.
+	Verify string
+	// Checksums is the path to a sha512sum file with the expected digests of the files in FilesDir.
+	Checksums string
+	// ProxyDHCP enables the proxyDHCP server.
+	ProxyDHCP bool
+	// ProxyDHCPAddr is the IP the proxyDHCP server listens on.
+	ProxyDHCPAddr string
+	// PublicIP is the IP proxyDHCP clients are told to fetch boot files from.
+	PublicIP string
+	// IPXEScriptURL is the boot filename proxyDHCP hands to clients already running iPXE.
+	IPXEScriptURL string
+	// AutoDefault is the file served for ipxe.AutoFile when the architecture of a machine is unknown.
+	AutoDefault string
+	// ACLAllow is a comma separated list of the only client IPs, IP ranges and CIDRs that are served.
+	ACLAllow string
+	// ACLDeny is a comma separated list of client IPs, IP ranges and CIDRs that are refused.
+	ACLDeny string
+	// ACLMACs is a comma separated list of the only MAC addresses that are served.
+	ACLMACs string
+	// AutoOverrides is the path to a JSON file of MAC addresses to the file served to them for ipxe.AutoFile.
+	AutoOverrides string
+	// ConfigFile is the path to a YAML or JSON file of flag names to values. It is read again on SIGHUP.
+	ConfigFile string
+
+	// fs is the flag set the flags are registered on.
+	fs *flag.FlagSet
+	// provided are the values of the flags set from the command line and the environment,
+	// which take precedence over ConfigFile when it is read again.
+	provided map[string]string
 }
 
 // IpxeBin returns the CLI command for the ipxe CLI app.
@@ -35,6 +159,7 @@ func IpxeBin() *ffcli.Command {
 		Name:       rootCLI,
 		ShortUsage: rootCLI,
 		FlagSet:    fs,
+		Options:    cfg.options(),
 		Exec: func(ctx context.Context, _ []string) error {
 			return cfg.Exec(ctx, nil)
 		},
@@ -43,9 +168,60 @@ func IpxeBin() *ffcli.Command {
 
 // RegisterFlags registers the flags for the ipxe CLI app.
 func RegisterFlags(cfg *Config, fs *flag.FlagSet) {
+	cfg.fs = fs
+	fs.StringVar(&cfg.ConfigFile, "config", "", "path to a YAML (.yaml, .yml) or JSON (.json) file of flag names to values, read again on SIGHUP, flags and "+envVarPrefix+"_ environment variables take precedence (optional)")
 	fs.StringVar(&cfg.TFTPAddr, "tftp-addr", "0.0.0.0:69", "IP and port to listen on for TFTP.")
 	fs.StringVar(&cfg.HTTPAddr, "http-addr", "0.0.0.0:8080", "IP and port to listen on for HTTP.")
+	fs.Var((*notBool)(&cfg.TFTPDisabled), "tftp-enabled", "serve files over TFTP (optional)")
+	fs.Var((*notBool)(&cfg.HTTPDisabled), "http-enabled", "serve files, the manifest and health checks over HTTP (optional)")
 	fs.StringVar(&cfg.LogLevel, "loglevel", "info", "log level (optional)")
+	fs.DurationVar(&cfg.TFTPTimeout, "tftp-timeout", 5*time.Second, "how long to wait for a TFTP acknowledgement before retransmitting (optional)")
+	fs.IntVar(&cfg.TFTPMaxRetries, "tftp-max-retries", 5, "maximum number of attempts to transmit a TFTP packet (optional)")
+	fs.StringVar(&cfg.TFTPBackoff, "tftp-backoff", "random", "wait between TFTP retransmissions: random (up to 1s), constant:<duration> or exponential:<base>[:<max>] (optional)")
+	fs.IntVar(&cfg.TFTPBlockSize, "tftp-block-size", 0, "maximum TFTP block size negotiated with clients, between 512 and 65464, 0 means limited only by the MTU (optional)")
+	fs.IntVar(&cfg.TFTPWindowSize, "tftp-window-size", 1, "maximum number of TFTP blocks sent before waiting for an acknowledgement, negotiated with clients that request the RFC 7440 windowsize option, not supported with -tftp-single-port (optional)")
+	fs.BoolVar(&cfg.TFTPSinglePort, "tftp-single-port", false, "serve all TFTP transfers from the -tftp-addr port instead of a new port per transfer, for NAT and firewalls (optional)")
+	fs.StringVar(&cfg.TFTPUploadDir, "tftp-upload-dir", "", "directory to write TFTP uploads to, in a subdirectory per client, uploads are refused when empty (optional)")
+	fs.Int64Var(&cfg.TFTPUploadMaxSize, "tftp-upload-max-size", 0, "maximum size of a single TFTP upload in bytes, 0 means no limit (optional)")
+	fs.Int64Var(&cfg.TFTPUploadQuota, "tftp-upload-quota", 0, "maximum total size of the TFTP uploads of a client in bytes, 0 means no limit (optional)")
+	fs.StringVar(&cfg.TFTPUploadPattern, "tftp-upload-pattern", "", "regular expression the names of TFTP uploads must match, all names are allowed when empty (optional)")
+	fs.IntVar(&cfg.TFTPMaxTransfers, "tftp-max-transfers", 0, "maximum number of concurrent TFTP transfers, 0 means no limit (optional)")
+	fs.IntVar(&cfg.TFTPMaxClientTransfers, "tftp-max-client-transfers", 0, "maximum number of concurrent TFTP transfers of a client IP, 0 means no limit (optional)")
+	fs.Float64Var(&cfg.TFTPRate, "tftp-rate", 0, "maximum number of TFTP requests per second, 0 means no limit (optional)")
+	fs.IntVar(&cfg.TFTPBurst, "tftp-burst", 0, "number of TFTP requests allowed at once above -tftp-rate, 0 means -tftp-rate rounded up (optional)")
+	fs.Float64Var(&cfg.TFTPClientRate, "tftp-client-rate", 0, "maximum number of TFTP requests per second of a client IP, 0 means no limit (optional)")
+	fs.IntVar(&cfg.TFTPClientBurst, "tftp-client-burst", 0, "number of TFTP requests of a client IP allowed at once above -tftp-client-rate, 0 means -tftp-client-rate rounded up (optional)")
+	fs.DurationVar(&cfg.TFTPQueueTimeout, "tftp-queue-timeout", 0, "how long TFTP requests over the transfer or rate limits wait before they are refused with an error clients do not retry, 0 means 3s, negative means no waiting (optional)")
+	fs.DurationVar(&cfg.HTTPReadTimeout, "http-read-timeout", 5*time.Second, "maximum duration for reading an entire HTTP request (optional)")
+	fs.DurationVar(&cfg.HTTPReadHeaderTimeout, "http-read-header-timeout", 5*time.Second, "maximum duration for reading HTTP request headers (optional)")
+	fs.DurationVar(&cfg.HTTPWriteTimeout, "http-write-timeout", time.Minute, "maximum duration for writing an HTTP response (optional)")
+	fs.DurationVar(&cfg.HTTPIdleTimeout, "http-idle-timeout", 2*time.Minute, "maximum duration to wait for the next request on a keep-alive HTTP connection (optional)")
+	fs.IntVar(&cfg.HTTPMaxConns, "http-max-conns", 0, "maximum number of concurrent HTTP connections, 0 means no limit (optional)")
+	fs.IntVar(&cfg.HTTPMaxHeaderBytes, "http-max-header-bytes", 0, "maximum size of HTTP request headers in bytes, 0 means the net/http default of 1MB (optional)")
+	fs.IntVar(&cfg.HTTPMaxTransfers, "http-max-transfers", 0, "maximum number of concurrent HTTP transfers, further requests get a 429 response, 0 means no limit (optional)")
+	fs.IntVar(&cfg.HTTPMaxClientTransfers, "http-max-client-transfers", 0, "maximum number of concurrent HTTP transfers of a client IP, 0 means no limit (optional)")
+	fs.Float64Var(&cfg.HTTPRate, "http-rate", 0, "maximum number of HTTP requests per second, 0 means no limit (optional)")
+	fs.IntVar(&cfg.HTTPBurst, "http-burst", 0, "number of HTTP requests allowed at once above -http-rate, 0 means -http-rate rounded up (optional)")
+	fs.Float64Var(&cfg.HTTPClientRate, "http-client-rate", 0, "maximum number of HTTP requests per second of a client IP, 0 means no limit (optional)")
+	fs.IntVar(&cfg.HTTPClientBurst, "http-client-burst", 0, "number of HTTP requests of a client IP allowed at once above -http-client-rate, 0 means -http-client-rate rounded up (optional)")
+	fs.DurationVar(&cfg.HTTPRetryAfter, "http-retry-after", time.Second, "how long HTTP clients refused for too many transfers in progress are told to wait in the Retry-After header (optional)")
+	fs.DurationVar(&cfg.DrainTimeout, "drain-timeout", 30*time.Second, "how long a shutdown waits for TFTP and HTTP transfers in progress to finish before aborting them (optional)")
+	fs.StringVar(&cfg.MetricsAddr, "metrics-addr", "", "IP and port to serve Prometheus metrics on at "+ipxe.MetricsPath+", and the "+ipxe.HealthzPath+" and "+ipxe.ReadyzPath+" health checks (optional)")
+	fs.StringVar(&cfg.FilesDir, "files-dir", "", "directory of files to serve, overlaid on top of the embedded iPXE binaries (optional)")
+	fs.BoolVar(&cfg.FilesDirOnly, "files-dir-only", false, "serve only the files in -files-dir, without the embedded iPXE binaries (optional)")
+	fs.StringVar(&cfg.EmbeddedScript, "embedded-script", "", "path to an iPXE script to patch into the served iPXE binaries, replacing their embedded script, requires the binaries of make binary/patchable in -files-dir, undionly.kpxe is never patched (optional)")
+	fs.StringVar(&cfg.Verify, "verify", "enforce", "what to do when a served file does not match its expected checksum: enforce (refuse to serve it), warn or off (optional)")
+	fs.StringVar(&cfg.Checksums, "checksums", "", "path to a sha512sum file with the expected digests of the files in -files-dir (optional)")
+	fs.BoolVar(&cfg.ProxyDHCP, "proxydhcp", false, "answer PXE clients with the iPXE binary for their architecture on ports 67 and 4011, needs TFTP (optional)")
+	fs.StringVar(&cfg.ProxyDHCPAddr, "proxydhcp-addr", "0.0.0.0", "IP to listen on for proxyDHCP (optional)")
+	fs.StringVar(&cfg.PublicIP, "public-ip", "", "IP proxyDHCP clients are told to fetch boot files from, defaults to the tftp-addr IP (optional)")
+	fs.StringVar(&cfg.IPXEScriptURL, "ipxe-script-url", "", "boot filename proxyDHCP hands to clients already running iPXE, they are ignored when empty (optional)")
+	fs.StringVar(&cfg.AutoDefault, "auto-default", "", "file served for "+ipxe.AutoFile+" when the architecture of a machine is unknown (optional)")
+	fs.StringVar(&cfg.AutoOverrides, "auto-overrides", "", "path to a JSON file of MAC addresses to the file served to them for "+ipxe.AutoFile+" (optional)")
+	fs.StringVar(&cfg.ACLAllow, "acl-allow", "", "comma separated list of the only client IPs, IP ranges (a-b) and CIDRs served over TFTP and HTTP, all are allowed when empty (optional)")
+	fs.StringVar(&cfg.ACLDeny, "acl-deny", "", "comma separated list of client IPs, IP ranges (a-b) and CIDRs refused over TFTP and HTTP, even when allowed by -acl-allow (optional)")
+	fs.StringVar(&cfg.ACLMACs, "acl-macs", "", "comma separated list of the only MAC addresses served, requests must then prefix the filename with the MAC address (optional)")
+	fs.StringVar(&cfg.MACScripts, "mac-scripts", "", "path to a JSON file of MAC addresses to iPXE scripts to patch into the iPXE binaries served to each machine, requires the binaries of make binary/patchable in -files-dir, undionly.kpxe is never patched (optional)")
 }
 
 // Exec is the main entry point for the ipxe CLI app.
@@ -54,6 +230,7 @@ func (f *Config) Exec(ctx context.Context, _ []string) error {
 		TFTPAddr: "0.0.0.0:69",
 		HTTPAddr: "0.0.0.0:8080",
 		LogLevel: "info",
+		Verify:   "enforce",
 		Log:      defaultLogger("info"),
 	}
 	err := mergo.Merge(f, defaults)
@@ -65,21 +242,259 @@ func (f *Config) Exec(ctx context.Context, _ []string) error {
 	}
 	f.Log = f.Log.WithName("ipxe")
 
+	// SIGHUP is caught before starting, by default it would exit the process during startup.
+	// One that arrives before the server is started reloads it once it is.
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	f.Log.Info("starting ipxe", "tftp-addr", f.TFTPAddr, "tftp-enabled", !f.TFTPDisabled, "http-addr", f.HTTPAddr, "http-enabled", !f.HTTPDisabled, "files-dir", f.FilesDir, "config", f.ConfigFile)
+	c, stop, err := f.config(ctx)
+	if err != nil {
+		return err
+	}
+	s, err := ipxe.NewServer(c)
+	if err != nil {
+		stop()
+		return err
+	}
+	if err := s.Start(ctx); err != nil {
+		stop()
+		return err
+	}
+
+	for {
+		select {
+		case <-s.Done():
+			stop()
+			return s.Err()
+		case <-hup:
+			stop = f.reload(ctx, s, stop)
+		}
+	}
+}
+
+// reload rebuilds the configuration and applies it to s without restarting its listeners.
+// A configuration that is not valid is logged and the previous one is kept. It returns the
+// func that stops watching the files of the configuration in use.
+func (f *Config) reload(ctx context.Context, s *ipxe.Server, stop context.CancelFunc) context.CancelFunc {
+	f.Log.Info("reloading configuration", "config", f.ConfigFile)
+	n, err := f.reparse()
+	var c ipxe.Config
+	var next context.CancelFunc
+	if err == nil {
+		c, next, err = n.config(ctx)
+	}
+	if err == nil {
+		if err = s.Reload(c); err != nil {
+			next()
+		}
+	}
+	if err != nil {
+		f.Log.Error(err, "could not reload configuration, keeping the previous configuration")
+		return stop
+	}
+	stop()
+	*f = *n
+	f.Log.Info("configuration reloaded")
+	return next
+}
+
+// options are the ff options the flags are parsed with. Flags take precedence over
+// environment variables, which take precedence over ConfigFile.
+func (f *Config) options() []ff.Option {
+	return []ff.Option{
+		ff.WithEnvVarPrefix(envVarPrefix),
+		ff.WithConfigFileFlag("config"),
+		ff.WithConfigFileParser(f.parseConfigFile),
+	}
+}
+
+// parseConfigFile is an ff.ConfigFileParser for ConfigFile, in the format of its extension.
+// It remembers the flags already set at this point, from the command line and the
+// environment, for reparse.
+func (f *Config) parseConfigFile(r io.Reader, set func(name, value string) error) error {
+	f.provided = map[string]string{}
+	f.fs.Visit(func(fl *flag.Flag) {
+		f.provided[fl.Name] = fl.Value.String()
+	})
+	switch ext := strings.ToLower(filepath.Ext(f.ConfigFile)); ext {
+	case ".yaml", ".yml":
+		return ffyaml.Parser(r, set)
+	case ".json":
+		return ff.JSONParser(r, set)
+	default:
+		return fmt.Errorf("unsupported config file extension %q, must be .yaml, .yml or .json", ext)
+	}
+}
+
+// reparse returns a copy of f with ConfigFile read again. The flags set from the command
+// line and the environment keep their values.
+func (f *Config) reparse() (*Config, error) {
+	if f.ConfigFile == "" {
+		n := *f
+		return &n, nil
+	}
+	n := &Config{}
+	fs := flag.NewFlagSet(rootCLI, flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	RegisterFlags(n, fs)
+	for name, value := range f.provided {
+		if err := fs.Set(name, value); err != nil {
+			return nil, errors.Wrapf(err, "could not set flag %q", name)
+		}
+	}
+	if err := ff.Parse(fs, nil, n.options()...); err != nil {
+		return nil, errors.Wrapf(err, "could not read config %q", f.ConfigFile)
+	}
+	n.Log = f.Log
+	return n, nil
+}
+
+// config builds the ipxe.Config from the flags, loading the files they refer to. The files-dir
+// is watched until the returned func is called.
+func (f *Config) config(ctx context.Context) (ipxe.Config, context.CancelFunc, error) {
 	tAddr, err := netaddr.ParseIPPort(f.TFTPAddr)
 	if err != nil {
-		return errors.Wrapf(err, "could not parse tftp-addr %q", f.TFTPAddr)
+		return ipxe.Config{}, nil, errors.Wrapf(err, "could not parse tftp-addr %q", f.TFTPAddr)
 	}
 	hAddr, err := netaddr.ParseIPPort(f.HTTPAddr)
 	if err != nil {
-		return errors.Wrapf(err, "could not parse http-addr %q", f.HTTPAddr)
+		return ipxe.Config{}, nil, errors.Wrapf(err, "could not parse http-addr %q", f.HTTPAddr)
+	}
+	verify, err := ipxe.ParseVerifyMode(f.Verify)
+	if err != nil {
+		return ipxe.Config{}, nil, err
+	}
+	backoff, err := ipxe.ParseBackoff(f.TFTPBackoff)
+	if err != nil {
+		return ipxe.Config{}, nil, err
 	}
-	f.Log.Info("starting ipxe", "tftp-addr", f.TFTPAddr, "http-addr", f.HTTPAddr)
 	c := ipxe.Config{
-		TFTP: ipxe.TFTP{Addr: tAddr},
-		HTTP: ipxe.HTTP{Addr: hAddr},
-		Log:  f.Log,
+		TFTP: ipxe.TFTP{
+			Disabled:   f.TFTPDisabled,
+			Addr:       tAddr,
+			Timeout:    f.TFTPTimeout,
+			MaxRetries: f.TFTPMaxRetries,
+			Backoff:    backoff,
+			BlockSize:  f.TFTPBlockSize,
+			WindowSize: f.TFTPWindowSize,
+			SinglePort: f.TFTPSinglePort,
+		},
+		HTTP: ipxe.HTTP{
+			Disabled:          f.HTTPDisabled,
+			Addr:              hAddr,
+			ReadTimeout:       f.HTTPReadTimeout,
+			ReadHeaderTimeout: f.HTTPReadHeaderTimeout,
+			WriteTimeout:      f.HTTPWriteTimeout,
+			IdleTimeout:       f.HTTPIdleTimeout,
+			MaxConns:          f.HTTPMaxConns,
+			MaxHeaderBytes:    f.HTTPMaxHeaderBytes,
+		},
+		Log:          f.Log,
+		Verify:       verify,
+		Auto:         ipxe.AutoSelect{Default: f.AutoDefault},
+		DrainTimeout: f.DrainTimeout,
+	}
+	if f.TFTPUploadDir != "" {
+		c.TFTP.Uploads = &ipxe.Uploads{Dir: f.TFTPUploadDir, MaxSize: f.TFTPUploadMaxSize, Quota: f.TFTPUploadQuota}
+		if f.TFTPUploadPattern != "" {
+			if c.TFTP.Uploads.Pattern, err = regexp.Compile(f.TFTPUploadPattern); err != nil {
+				return ipxe.Config{}, nil, errors.Wrapf(err, "could not parse tftp-upload-pattern %q", f.TFTPUploadPattern)
+			}
+		}
+	}
+	if c.ACL, err = f.acl(); err != nil {
+		return ipxe.Config{}, nil, err
+	}
+	c.TFTP.Limits = limiter(&ipxe.Limiter{
+		MaxTransfers:       f.TFTPMaxTransfers,
+		MaxClientTransfers: f.TFTPMaxClientTransfers,
+		Rate:               f.TFTPRate,
+		Burst:              f.TFTPBurst,
+		ClientRate:         f.TFTPClientRate,
+		ClientBurst:        f.TFTPClientBurst,
+		QueueTimeout:       f.TFTPQueueTimeout,
+	})
+	c.HTTP.Limits = limiter(&ipxe.Limiter{
+		MaxTransfers:       f.HTTPMaxTransfers,
+		MaxClientTransfers: f.HTTPMaxClientTransfers,
+		Rate:               f.HTTPRate,
+		Burst:              f.HTTPBurst,
+		ClientRate:         f.HTTPClientRate,
+		ClientBurst:        f.HTTPClientBurst,
+		RetryAfter:         f.HTTPRetryAfter,
+	})
+	if f.MetricsAddr != "" {
+		if c.Metrics.Addr, err = netaddr.ParseIPPort(f.MetricsAddr); err != nil {
+			return ipxe.Config{}, nil, errors.Wrapf(err, "could not parse metrics-addr %q", f.MetricsAddr)
+		}
+	}
+	if f.ProxyDHCP {
+		c.ProxyDHCP = ipxe.ProxyDHCP{Enabled: true, IPXEScriptURL: f.IPXEScriptURL}
+		if c.ProxyDHCP.Addr, err = parseOptionalIP(f.ProxyDHCPAddr); err != nil {
+			return ipxe.Config{}, nil, errors.Wrapf(err, "could not parse proxydhcp-addr %q", f.ProxyDHCPAddr)
+		}
+		if c.ProxyDHCP.PublicIP, err = parseOptionalIP(f.PublicIP); err != nil {
+			return ipxe.Config{}, nil, errors.Wrapf(err, "could not parse public-ip %q", f.PublicIP)
+		}
+	}
+	if f.Checksums != "" {
+		cf, err := os.Open(f.Checksums)
+		if err != nil {
+			return ipxe.Config{}, nil, errors.Wrapf(err, "could not read checksums %q", f.Checksums)
+		}
+		sums, err := binary.ParseChecksums(cf)
+		cf.Close()
+		if err != nil {
+			return ipxe.Config{}, nil, errors.Wrapf(err, "could not parse checksums %q", f.Checksums)
+		}
+		c.Checksums = sums
+	}
+	if f.EmbeddedScript != "" {
+		script, err := ioutil.ReadFile(f.EmbeddedScript)
+		if err != nil {
+			return ipxe.Config{}, nil, errors.Wrapf(err, "could not read embedded-script %q", f.EmbeddedScript)
+		}
+		c.EmbeddedScript = script
+	}
+	if f.MACScripts != "" {
+		scripts, err := ipxe.LoadScriptMap(f.MACScripts)
+		if err != nil {
+			return ipxe.Config{}, nil, errors.Wrapf(err, "could not load mac-scripts %q", f.MACScripts)
+		}
+		c.Scripts = scripts
 	}
-	return c.Serve(ctx)
+	if f.AutoOverrides != "" {
+		overrides, err := ipxe.LoadAutoOverrides(f.AutoOverrides)
+		if err != nil {
+			return ipxe.Config{}, nil, errors.Wrapf(err, "could not load auto-overrides %q", f.AutoOverrides)
+		}
+		c.Auto.Overrides = overrides
+	}
+	stop := func() {}
+	if f.FilesDir != "" {
+		ds := &ipxe.DirSource{Dir: f.FilesDir, Checksums: c.Checksums, Verify: verify, Log: f.Log.WithName("files")}
+		if !f.FilesDirOnly {
+			ds.Fallback = ipxe.EmbeddedSource()
+		}
+		if err := ds.Scan(); err != nil {
+			return ipxe.Config{}, nil, errors.Wrapf(err, "could not read files-dir %q", f.FilesDir)
+		}
+		ctx, cancel := context.WithCancel(ctx)
+		go ds.Watch(ctx)
+		c.Files = ds
+		stop = cancel
+	}
+	return c, stop, nil
+}
+
+// parseOptionalIP parses s as an IP address, an empty string is the zero IP.
+func parseOptionalIP(s string) (netaddr.IP, error) {
+	if s == "" {
+		return netaddr.IP{}, nil
+	}
+	return netaddr.ParseIP(s)
 }
 
 // defaultLogger is zap logr implementation.
@@ -99,3 +514,67 @@ func defaultLogger(level string) logr.Logger {
 
 	return zapr.NewLogger(zapLogger)
 }
+
+// acl returns the ACL configured with the acl flags, nil when none are set.
+func (f *Config) acl() (*ipxe.ACL, error) {
+	if f.ACLAllow == "" && f.ACLDeny == "" && f.ACLMACs == "" {
+		return nil, nil
+	}
+	a := &ipxe.ACL{}
+	var err error
+	if a.Allow, err = ipxe.ParseIPSet(splitList(f.ACLAllow)); err != nil {
+		return nil, errors.Wrap(err, "could not parse acl-allow")
+	}
+	if a.Deny, err = ipxe.ParseIPSet(splitList(f.ACLDeny)); err != nil {
+		return nil, errors.Wrap(err, "could not parse acl-deny")
+	}
+	for _, m := range splitList(f.ACLMACs) {
+		mac, err := net.ParseMAC(m)
+		if err != nil {
+			return nil, errors.Wrapf(err, "could not parse acl-macs %q", m)
+		}
+		a.MACs = append(a.MACs, mac)
+	}
+	return a, nil
+}
+
+// notBool is a bool flag.Value that stores the negation of the flag, so that a flag for
+// something on by default can set a field that is false by default.
+type notBool bool
+
+func (b *notBool) Set(s string) error {
+	v, err := strconv.ParseBool(s)
+	if err != nil {
+		return err
+	}
+	*b = notBool(!v)
+	return nil
+}
+
+func (b *notBool) String() string {
+	if b == nil {
+		return "true"
+	}
+	return strconv.FormatBool(!bool(*b))
+}
+
+func (b *notBool) IsBoolFlag() bool { return true }
+
+// limiter returns l, nil when it sets no limits.
+func limiter(l *ipxe.Limiter) *ipxe.Limiter {
+	if l.MaxTransfers <= 0 && l.MaxClientTransfers <= 0 && l.Rate <= 0 && l.ClientRate <= 0 {
+		return nil
+	}
+	return l
+}
+
+// splitList splits a comma separated list, ignoring empty elements and surrounding space.
+func splitList(s string) []string {
+	var l []string
+	for _, e := range strings.Split(s, ",") {
+		if e = strings.TrimSpace(e); e != "" {
+			l = append(l, e)
+		}
+	}
+	return l
+}
@@ -0,0 +1,305 @@
+package cli
+
+import (
+	"context"
+	"flag"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-logr/logr"
+	"github.com/google/go-cmp/cmp"
+	"github.com/jacobweinstock/ipxe"
+	"github.com/peterbourgon/ff/v3"
+	"inet.af/netaddr"
+)
+
+// parse parses args, the environment and the config file they name the way IpxeBin does.
+func parse(t *testing.T, args ...string) (*Config, error) {
+	t.Helper()
+	cfg := &Config{Log: logr.Discard()}
+	fs := flag.NewFlagSet(rootCLI, flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	RegisterFlags(cfg, fs)
+	return cfg, ff.Parse(fs, args, cfg.options()...)
+}
+
+// writeFile writes content to name in dir and returns its path.
+func writeFile(t *testing.T, dir, name, content string) string {
+	t.Helper()
+	p := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(p, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+// setenv sets the environment variable key to value for the duration of the test.
+func setenv(t *testing.T, key, value string) {
+	t.Helper()
+	prev, ok := os.LookupEnv(key)
+	if err := os.Setenv(key, value); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if ok {
+			os.Setenv(key, prev)
+		} else {
+			os.Unsetenv(key)
+		}
+	})
+}
+
+func TestConfig_Precedence(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		content string
+		wantErr bool
+	}{
+		{name: "yaml", file: "ipxe.yaml", content: "tftp-addr: 127.0.0.1:6969\nhttp-addr: 127.0.0.1:8081\nloglevel: error\nmetrics-addr: 127.0.0.1:9090\n"},
+		{name: "yml", file: "ipxe.yml", content: "tftp-addr: 127.0.0.1:6969\nhttp-addr: 127.0.0.1:8081\nloglevel: error\nmetrics-addr: 127.0.0.1:9090\n"},
+		{name: "json", file: "ipxe.json", content: `{"tftp-addr": "127.0.0.1:6969", "http-addr": "127.0.0.1:8081", "loglevel": "error", "metrics-addr": "127.0.0.1:9090"}`},
+		{name: "unsupported extension", file: "ipxe.toml", content: "tftp-addr = \"127.0.0.1:6969\"\n", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := writeFile(t, t.TempDir(), tt.file, tt.content)
+			setenv(t, "IPXE_HTTP_ADDR", "127.0.0.1:8082")
+			setenv(t, "IPXE_LOGLEVEL", "info")
+			cfg, err := parse(t, "-config", path, "-loglevel", "debug")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got err: %v, wantErr: %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			// the file sets tftp-addr and metrics-addr, the environment overrides http-addr and the flag loglevel.
+			got := []string{cfg.TFTPAddr, cfg.HTTPAddr, cfg.LogLevel, cfg.MetricsAddr}
+			if diff := cmp.Diff(got, []string{"127.0.0.1:6969", "127.0.0.1:8082", "debug", "127.0.0.1:9090"}); diff != "" {
+				t.Fatal(diff)
+			}
+
+			c, stop, err := cfg.config(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer stop()
+			want := []netaddr.IPPort{
+				netaddr.MustParseIPPort("127.0.0.1:6969"),
+				netaddr.MustParseIPPort("127.0.0.1:8082"),
+				netaddr.MustParseIPPort("127.0.0.1:9090"),
+			}
+			if diff := cmp.Diff([]netaddr.IPPort{c.TFTP.Addr, c.HTTP.Addr, c.Metrics.Addr}, want, cmp.Comparer(func(a, b netaddr.IPPort) bool { return a == b })); diff != "" {
+				t.Fatal(diff)
+			}
+		})
+	}
+}
+
+func TestConfig_Defaults(t *testing.T) {
+	cfg, err := parse(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, stop, err := cfg.config(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stop()
+	if c.TFTP.Disabled || c.HTTP.Disabled {
+		t.Fatalf("got tftp disabled: %v, http disabled: %v, want both enabled", c.TFTP.Disabled, c.HTTP.Disabled)
+	}
+	if !c.Metrics.Addr.IsZero() {
+		t.Fatalf("got metrics addr %v, want none", c.Metrics.Addr)
+	}
+	if c.TFTP.Limits != nil || c.HTTP.Limits != nil || c.TFTP.Uploads != nil || c.ACL != nil {
+		t.Fatal("expected no limits, uploads or ACL")
+	}
+}
+
+func TestConfig_Enabled(t *testing.T) {
+	tests := []struct {
+		name         string
+		args         []string
+		env          map[string]string
+		file         string
+		wantTFTPOff  bool
+		wantHTTPOff  bool
+		wantParseErr bool
+	}{
+		{name: "default"},
+		{name: "flags", args: []string{"-tftp-enabled=false", "-http-enabled=false"}, wantTFTPOff: true, wantHTTPOff: true},
+		{name: "bool flag", args: []string{"-tftp-enabled", "-http-enabled=0"}, wantHTTPOff: true},
+		{name: "environment", env: map[string]string{"IPXE_TFTP_ENABLED": "false"}, wantTFTPOff: true},
+		{name: "file", file: "http-enabled: false\n", wantHTTPOff: true},
+		{name: "flag over file", args: []string{"-http-enabled=true"}, file: "http-enabled: false\n"},
+		{name: "invalid", args: []string{"-tftp-enabled=maybe"}, wantParseErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for k, v := range tt.env {
+				setenv(t, k, v)
+			}
+			args := tt.args
+			if tt.file != "" {
+				args = append([]string{"-config", writeFile(t, t.TempDir(), "ipxe.yaml", tt.file)}, args...)
+			}
+			cfg, err := parse(t, args...)
+			if (err != nil) != tt.wantParseErr {
+				t.Fatalf("got err: %v, wantErr: %v", err, tt.wantParseErr)
+			}
+			if tt.wantParseErr {
+				return
+			}
+			c, stop, err := cfg.config(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer stop()
+			if c.TFTP.Disabled != tt.wantTFTPOff || c.HTTP.Disabled != tt.wantHTTPOff {
+				t.Fatalf("got tftp disabled: %v, http disabled: %v, want: %v, %v", c.TFTP.Disabled, c.HTTP.Disabled, tt.wantTFTPOff, tt.wantHTTPOff)
+			}
+		})
+	}
+}
+
+func TestConfig_Telemetry(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    []string
+		want    netaddr.IPPort
+		wantErr bool
+	}{
+		{name: "not served"},
+		{name: "served", args: []string{"-metrics-addr", "127.0.0.1:9090"}, want: netaddr.MustParseIPPort("127.0.0.1:9090")},
+		{name: "invalid", args: []string{"-metrics-addr", "localhost"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := parse(t, tt.args...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			c, stop, err := cfg.config(context.Background())
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got err: %v, wantErr: %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			defer stop()
+			if c.Metrics.Addr != tt.want {
+				t.Fatalf("got metrics addr %v, want %v", c.Metrics.Addr, tt.want)
+			}
+		})
+	}
+}
+
+func TestConfig_Reparse(t *testing.T) {
+	dir := t.TempDir()
+	path := writeFile(t, dir, "ipxe.yaml", "tftp-addr: 127.0.0.1:6969\nloglevel: error\nacl-deny: 192.0.2.1\n")
+	setenv(t, "IPXE_HTTP_ADDR", "127.0.0.1:8082")
+	cfg, err := parse(t, "-config", path, "-loglevel", "debug")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writeFile(t, dir, "ipxe.yaml", "tftp-addr: 127.0.0.1:7070\nhttp-addr: 127.0.0.1:8083\nloglevel: error\nacl-deny: 192.0.2.2\n")
+	// the environment read at startup is kept.
+	setenv(t, "IPXE_HTTP_ADDR", "127.0.0.1:8084")
+	n, err := cfg.reparse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := []string{n.TFTPAddr, n.HTTPAddr, n.LogLevel, n.ACLDeny, n.ConfigFile}
+	if diff := cmp.Diff(got, []string{"127.0.0.1:7070", "127.0.0.1:8082", "debug", "192.0.2.2", path}); diff != "" {
+		t.Fatal(diff)
+	}
+	// reparse leaves the configuration in use alone.
+	if cfg.TFTPAddr != "127.0.0.1:6969" || cfg.ACLDeny != "192.0.2.1" {
+		t.Fatalf("configuration in use changed, tftp-addr: %v, acl-deny: %v", cfg.TFTPAddr, cfg.ACLDeny)
+	}
+
+	writeFile(t, dir, "ipxe.yaml", "tftp-addr: [\n")
+	if _, err := cfg.reparse(); err == nil {
+		t.Fatal("expected an error reading an invalid config file")
+	}
+}
+
+func TestConfig_ReparseWithoutFile(t *testing.T) {
+	cfg, err := parse(t, "-tftp-addr", "127.0.0.1:6969")
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := cfg.reparse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n == cfg || n.TFTPAddr != "127.0.0.1:6969" {
+		t.Fatalf("expected a copy of the configuration, got tftp-addr %v", n.TFTPAddr)
+	}
+}
+
+func TestConfig_Reload(t *testing.T) {
+	dir := t.TempDir()
+	files := filepath.Join(dir, "files")
+	if err := os.Mkdir(files, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, files, "ipxe.efi", "ipxe")
+	path := writeFile(t, dir, "ipxe.yaml", "tftp-enabled: false\nhttp-addr: 127.0.0.1:0\nfiles-dir-only: true\nverify: \"off\"\n")
+	cfg, err := parse(t, "-config", path, "-files-dir", files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c, stop, err := cfg.config(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := ipxe.NewServer(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Shutdown(context.Background())
+	status := func() int {
+		t.Helper()
+		resp, err := http.Get("http://" + s.HTTPAddr().String() + "/ipxe.efi")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if got := status(); got != http.StatusOK {
+		t.Fatalf("got status %v, want %v", got, http.StatusOK)
+	}
+
+	// an invalid configuration is not applied.
+	writeFile(t, dir, "ipxe.yaml", "tftp-enabled: false\nhttp-addr: 127.0.0.1:0\nfiles-dir-only: true\nverify: \"off\"\nacl-deny: not-an-ip\n")
+	prev := *cfg
+	stop = cfg.reload(ctx, s, stop)
+	if cfg.ACLDeny != prev.ACLDeny {
+		t.Fatalf("got acl-deny %q, want %q", cfg.ACLDeny, prev.ACLDeny)
+	}
+	if got := status(); got != http.StatusOK {
+		t.Fatalf("got status %v, want %v", got, http.StatusOK)
+	}
+
+	writeFile(t, dir, "ipxe.yaml", "tftp-enabled: false\nhttp-addr: 127.0.0.1:0\nfiles-dir-only: true\nverify: \"off\"\nacl-deny: 127.0.0.1\n")
+	stop = cfg.reload(ctx, s, stop)
+	defer stop()
+	if cfg.ACLDeny != "127.0.0.1" {
+		t.Fatalf("got acl-deny %q, want %q", cfg.ACLDeny, "127.0.0.1")
+	}
+	if got := status(); got != http.StatusForbidden {
+		t.Fatalf("got status %v, want %v", got, http.StatusForbidden)
+	}
+}
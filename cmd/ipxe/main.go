@@ -17,7 +17,7 @@ func main() {
 		os.Exit(exitCode)
 	}()
 
-	ctx, done := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGHUP, syscall.SIGTERM)
+	ctx, done := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer done()
 
 	root := cli.IpxeBin()
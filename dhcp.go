@@ -0,0 +1,432 @@
+package ipxe
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/go-logr/logr"
+	"inet.af/netaddr"
+)
+
+// DHCP ports used by the proxyDHCP server.
+const (
+	// ProxyDHCPPort is the standard DHCP server port, PXE clients broadcast DHCPDISCOVER to it.
+	ProxyDHCPPort = 67
+	// PXEPort is the PXE boot server port, PXE clients send DHCPREQUEST to it after accepting a proxyDHCP offer.
+	PXEPort = 4011
+	// dhcpClientPort is the port DHCP clients listen on.
+	dhcpClientPort = 68
+)
+
+// DHCP message types, option 53.
+const (
+	dhcpDiscover = 1
+	dhcpOffer    = 2
+	dhcpRequest  = 3
+	dhcpAck      = 5
+	dhcpInform   = 8
+)
+
+// DHCP option codes.
+const (
+	optPad             = 0
+	optVendorSpecific  = 43
+	optRequestedIP     = 50
+	optMessageType     = 53
+	optServerID        = 54
+	optVendorClass     = 60
+	optUserClass       = 77
+	optClientArch      = 93
+	optClientMachineID = 97
+	optIPXEEncap       = 175
+	optEnd             = 255
+)
+
+const (
+	bootRequest = 1
+	bootReply   = 2
+	// bootpHeaderLen is the length of the fixed part of a BOOTP message, before the magic cookie.
+	bootpHeaderLen = 236
+	// pxeDiscoveryControl is PXE vendor sub-option 6. The value 8 (bit 3) tells clients to
+	// download the boot filename in this offer and skip boot server discovery, so they do not
+	// always send a DHCPREQUEST to PXEPort.
+	pxeDiscoveryControl = 6
+)
+
+// errOtherServer is returned by reply for requests addressed to another DHCP server.
+var errOtherServer = errors.New("request for another DHCP server")
+
+var magicCookie = []byte{99, 130, 83, 99}
+
+// Arch is a DHCP client system architecture type, option 93. See RFC 4578 and the IANA registry.
+type Arch uint16
+
+// Client system architectures with a matching embedded iPXE binary.
+const (
+	ArchX86BIOS      Arch = 0
+	ArchX64EFIBC     Arch = 7
+	ArchX64EFI       Arch = 9
+	ArchARM64EFI     Arch = 11
+	ArchX64EFIHTTP   Arch = 16
+	ArchARM64EFIHTTP Arch = 19
+)
+
+// archBootFiles are the iPXE binaries for each client architecture.
+var archBootFiles = map[Arch]string{
+	ArchX86BIOS:      "undionly.kpxe",
+	ArchX64EFIBC:     "ipxe.efi",
+	ArchX64EFI:       "ipxe.efi",
+	ArchARM64EFI:     "snp.efi",
+	ArchX64EFIHTTP:   "ipxe.efi",
+	ArchARM64EFIHTTP: "snp.efi",
+}
+
+// BootFile returns the name of the iPXE binary for the architecture.
+// ok is false when there is no binary for it.
+func (a Arch) BootFile() (name string, ok bool) {
+	name, ok = archBootFiles[a]
+	return name, ok
+}
+
+// HandleProxyDHCP answers PXE clients with the iPXE boot filename for their architecture,
+// pointing them at the TFTP or HTTP server. It never hands out IP addresses, another DHCP
+// server on the network must do that.
+type HandleProxyDHCP struct {
+	Log logr.Logger
+	// TFTPAddr is the address clients fetch boot files from over TFTP. Its IP is used as the
+	// DHCP server identifier and next-server. When zero, PXE clients are not answered.
+	TFTPAddr netaddr.IPPort
+	// HTTPAddr is the address UEFI HTTP Boot clients fetch boot files from. When zero, they
+	// are not answered. Its IP is the server identifier when TFTPAddr is zero.
+	HTTPAddr netaddr.IPPort
+	// IPXEScriptURL is the boot filename handed to clients already running iPXE.
+	// When empty they are not answered, so they do not chainload iPXE again.
+	IPXEScriptURL string
+	// Archs, when set, records the architecture of every client answered, for AutoSource.
+	Archs *ArchCache
+}
+
+// ListenAndServeProxyDHCP listens on the UDP address addr and answers PXE clients until ctx is canceled.
+func ListenAndServeProxyDHCP(ctx context.Context, addr netaddr.IPPort, h *HandleProxyDHCP) error {
+	conn, err := net.ListenUDP("udp4", addr.UDPAddr())
+	if err != nil {
+		return err
+	}
+	return ServeProxyDHCP(ctx, conn, h)
+}
+
+// ServeProxyDHCP answers PXE clients on conn until ctx is canceled. It closes conn before returning.
+// When conn is bound to PXEPort DHCPREQUESTs are answered, on any other port only DHCPDISCOVERs
+// and the DHCPREQUESTs whose server identifier is the proxyDHCP server are.
+func ServeProxyDHCP(ctx context.Context, conn net.PacketConn, h *HandleProxyDHCP) error {
+	var port int
+	if a, ok := conn.LocalAddr().(*net.UDPAddr); ok {
+		port = a.Port
+	}
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+	buf := make([]byte, 1500)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		if err := h.handle(conn, addr, buf[:n], port); err != nil {
+			h.Log.V(1).Info("ignoring DHCP packet", "client", addr.String(), "reason", err.Error())
+		}
+	}
+}
+
+// handle answers a single DHCP packet received on conn, bound to port.
+func (h *HandleProxyDHCP) handle(conn net.PacketConn, addr net.Addr, b []byte, port int) error {
+	req, err := parseDHCP(b)
+	if err != nil {
+		return err
+	}
+	to, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return fmt.Errorf("unexpected address type %T", addr)
+	}
+	reply, err := h.reply(req, port)
+	arch, _ := req.arch()
+	// the requests of PXE clients to the DHCP server carry the IP they are given, which HTTP
+	// clients are recognized by.
+	if h.Archs != nil && (err == nil || errors.Is(err, errOtherServer)) {
+		h.Archs.Record(req.mac(), req.clientIP(to.IP), arch)
+	}
+	if err != nil {
+		return err
+	}
+	dst := replyAddr(req, to)
+	if _, err := conn.WriteTo(reply.marshal(), dst); err != nil {
+		h.Log.Error(err, "sending proxyDHCP reply failed", "mac", req.mac().String(), "dst", dst.String())
+		return nil
+	}
+	h.Log.Info("sent proxyDHCP reply", "mac", req.mac().String(), "arch", arch, "file", string(bytes.TrimRight(reply.file[:], "\x00")), "dst", dst.String())
+	return nil
+}
+
+// reply builds the proxyDHCP reply to req, received on port. DHCPDISCOVERs are offered a boot
+// file on any port but PXEPort. DHCPREQUESTs and DHCPINFORMs are acknowledged on PXEPort, on
+// other ports only when their server identifier is the proxyDHCP server, otherwise
+// errOtherServer is returned.
+func (h *HandleProxyDHCP) reply(req *dhcpPacket, port int) (*dhcpPacket, error) {
+	if req.op != bootRequest {
+		return nil, errors.New("not a BOOTREQUEST")
+	}
+	vendor := string(req.options[optVendorClass])
+	var class string
+	switch {
+	case strings.HasPrefix(vendor, "PXEClient"):
+		class = "PXEClient"
+	case strings.HasPrefix(vendor, "HTTPClient"):
+		class = "HTTPClient"
+	default:
+		return nil, fmt.Errorf("not a PXE client, vendor class %q", vendor)
+	}
+	arch, ok := req.arch()
+	if !ok {
+		return nil, errors.New("no client architecture, option 93")
+	}
+
+	serverIP := h.TFTPAddr.IP()
+	if h.TFTPAddr.IsZero() {
+		serverIP = h.HTTPAddr.IP()
+	}
+	sid := serverIP.As4()
+	var replyType byte
+	switch t := req.messageType(); {
+	case t == dhcpDiscover && port != PXEPort:
+		replyType = dhcpOffer
+	case (t == dhcpRequest || t == dhcpInform) && port != PXEPort && !bytes.Equal(req.options[optServerID], sid[:]):
+		return nil, errOtherServer
+	case t == dhcpRequest || t == dhcpInform:
+		replyType = dhcpAck
+	default:
+		return nil, fmt.Errorf("unsupported message type %d on port %d", t, port)
+	}
+
+	var file string
+	switch {
+	case req.isIPXE():
+		if h.IPXEScriptURL == "" {
+			return nil, errors.New("client is already running iPXE and no iPXE script URL is configured")
+		}
+		file = h.IPXEScriptURL
+	case class == "HTTPClient":
+		if h.HTTPAddr.IsZero() {
+			return nil, errors.New("UEFI HTTP Boot client and HTTP is disabled")
+		}
+		name, ok := arch.BootFile()
+		if !ok {
+			return nil, fmt.Errorf("no boot file for architecture %d", arch)
+		}
+		file = fmt.Sprintf("http://%v/%v", h.HTTPAddr, name)
+	default:
+		if h.TFTPAddr.IsZero() {
+			return nil, errors.New("PXE client and TFTP is disabled")
+		}
+		name, ok := arch.BootFile()
+		if !ok {
+			return nil, fmt.Errorf("no boot file for architecture %d", arch)
+		}
+		file = name
+	}
+	rep := &dhcpPacket{
+		op:      bootReply,
+		htype:   req.htype,
+		hlen:    req.hlen,
+		xid:     req.xid,
+		flags:   req.flags,
+		ciaddr:  req.ciaddr,
+		giaddr:  req.giaddr,
+		chaddr:  req.chaddr,
+		options: map[byte][]byte{},
+	}
+	// the file field must stay NUL terminated.
+	if len(file) >= len(rep.file) {
+		return nil, fmt.Errorf("boot filename %q is too long", file)
+	}
+	rep.siaddr = serverIP.As4()
+	copy(rep.file[:], file)
+	rep.options[optMessageType] = []byte{replyType}
+	rep.options[optServerID] = sid[:]
+	rep.options[optVendorClass] = []byte(class)
+	if id, ok := req.options[optClientMachineID]; ok {
+		rep.options[optClientMachineID] = id
+	}
+	if class == "PXEClient" {
+		rep.options[optVendorSpecific] = []byte{pxeDiscoveryControl, 1, 8, optEnd}
+	}
+	return rep, nil
+}
+
+// replyAddr returns where to send the reply to req, received from src.
+func replyAddr(req *dhcpPacket, src *net.UDPAddr) *net.UDPAddr {
+	if gi := netaddr.IPv4(req.giaddr[0], req.giaddr[1], req.giaddr[2], req.giaddr[3]); !gi.IsUnspecified() {
+		return &net.UDPAddr{IP: gi.IPAddr().IP, Port: ProxyDHCPPort}
+	}
+	if src.IP.IsUnspecified() || src.IP.Equal(net.IPv4bcast) {
+		return &net.UDPAddr{IP: net.IPv4bcast, Port: dhcpClientPort}
+	}
+	return src
+}
+
+// dhcpPacket is a DHCPv4 message, RFC 2131.
+type dhcpPacket struct {
+	op, htype, hlen, hops byte
+	xid                   uint32
+	secs, flags           uint16
+	ciaddr, yiaddr        [4]byte
+	siaddr, giaddr        [4]byte
+	chaddr                [16]byte
+	sname                 [64]byte
+	file                  [128]byte
+	options               map[byte][]byte
+}
+
+func parseDHCP(b []byte) (*dhcpPacket, error) {
+	if len(b) < bootpHeaderLen+len(magicCookie) {
+		return nil, fmt.Errorf("packet too short, %d bytes", len(b))
+	}
+	if !bytes.Equal(b[bootpHeaderLen:bootpHeaderLen+4], magicCookie) {
+		return nil, errors.New("missing DHCP magic cookie")
+	}
+	p := &dhcpPacket{
+		op:      b[0],
+		htype:   b[1],
+		hlen:    b[2],
+		hops:    b[3],
+		xid:     binary.BigEndian.Uint32(b[4:8]),
+		secs:    binary.BigEndian.Uint16(b[8:10]),
+		flags:   binary.BigEndian.Uint16(b[10:12]),
+		options: map[byte][]byte{},
+	}
+	copy(p.ciaddr[:], b[12:16])
+	copy(p.yiaddr[:], b[16:20])
+	copy(p.siaddr[:], b[20:24])
+	copy(p.giaddr[:], b[24:28])
+	copy(p.chaddr[:], b[28:44])
+	copy(p.sname[:], b[44:108])
+	copy(p.file[:], b[108:236])
+	if p.hlen > 16 {
+		return nil, fmt.Errorf("invalid hardware address length %d", p.hlen)
+	}
+
+	opts := b[bootpHeaderLen+4:]
+	for i := 0; i < len(opts); {
+		code := opts[i]
+		if code == optEnd {
+			break
+		}
+		if code == optPad {
+			i++
+			continue
+		}
+		if i+1 >= len(opts) || i+2+int(opts[i+1]) > len(opts) {
+			return nil, fmt.Errorf("option %d overflows the packet", code)
+		}
+		l := int(opts[i+1])
+		// options split across multiple instances are concatenated, RFC 3396.
+		p.options[code] = append(p.options[code], opts[i+2:i+2+l]...)
+		i += 2 + l
+	}
+	return p, nil
+}
+
+func (p *dhcpPacket) marshal() []byte {
+	b := make([]byte, bootpHeaderLen, 300)
+	b[0], b[1], b[2], b[3] = p.op, p.htype, p.hlen, p.hops
+	binary.BigEndian.PutUint32(b[4:8], p.xid)
+	binary.BigEndian.PutUint16(b[8:10], p.secs)
+	binary.BigEndian.PutUint16(b[10:12], p.flags)
+	copy(b[12:16], p.ciaddr[:])
+	copy(b[16:20], p.yiaddr[:])
+	copy(b[20:24], p.siaddr[:])
+	copy(b[24:28], p.giaddr[:])
+	copy(b[28:44], p.chaddr[:])
+	copy(b[44:108], p.sname[:])
+	copy(b[108:236], p.file[:])
+	b = append(b, magicCookie...)
+	// message type first, as some clients expect it.
+	if mt, ok := p.options[optMessageType]; ok {
+		b = append(b, optMessageType, byte(len(mt)))
+		b = append(b, mt...)
+	}
+	for code := 1; code < optEnd; code++ {
+		v, ok := p.options[byte(code)]
+		if !ok || code == optMessageType {
+			continue
+		}
+		for len(v) > 255 {
+			b = append(b, byte(code), 255)
+			b = append(b, v[:255]...)
+			v = v[255:]
+		}
+		b = append(b, byte(code), byte(len(v)))
+		b = append(b, v...)
+	}
+	b = append(b, optEnd)
+	// pad to the minimum BOOTP message size, some clients drop shorter replies.
+	for len(b) < 300 {
+		b = append(b, optPad)
+	}
+	return b
+}
+
+func (p *dhcpPacket) messageType() byte {
+	if mt := p.options[optMessageType]; len(mt) == 1 {
+		return mt[0]
+	}
+	return 0
+}
+
+// clientIP returns the IP of the client that sent p from src: src when it is set, otherwise
+// the client IP or the requested IP, option 50. It is the zero IP when none is known.
+func (p *dhcpPacket) clientIP(src net.IP) netaddr.IP {
+	if ip, ok := netaddr.FromStdIP(src); ok && !ip.IsUnspecified() {
+		return ip
+	}
+	if ci := netaddr.IPv4(p.ciaddr[0], p.ciaddr[1], p.ciaddr[2], p.ciaddr[3]); !ci.IsUnspecified() {
+		return ci
+	}
+	if r := p.options[optRequestedIP]; len(r) == 4 {
+		return netaddr.IPv4(r[0], r[1], r[2], r[3])
+	}
+	return netaddr.IP{}
+}
+
+func (p *dhcpPacket) mac() net.HardwareAddr {
+	return net.HardwareAddr(p.chaddr[:p.hlen])
+}
+
+// arch returns the client system architecture, option 93.
+// Clients may list several architectures, the first one is used.
+func (p *dhcpPacket) arch() (Arch, bool) {
+	a := p.options[optClientArch]
+	if len(a) < 2 {
+		return 0, false
+	}
+	return Arch(binary.BigEndian.Uint16(a[:2])), true
+}
+
+// isIPXE reports whether the client is already running iPXE.
+// iPXE sends its own encapsulated options (175) and the user class (77) "iPXE",
+// the embedded script in the iPXE binaries sets the user class to "Tinkerbell".
+func (p *dhcpPacket) isIPXE() bool {
+	if _, ok := p.options[optIPXEEncap]; ok {
+		return true
+	}
+	uc := p.options[optUserClass]
+	return bytes.Contains(uc, []byte("iPXE")) || bytes.Contains(uc, []byte("Tinkerbell"))
+}
@@ -0,0 +1,317 @@
+package ipxe
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/google/go-cmp/cmp"
+	"inet.af/netaddr"
+)
+
+// testDHCPPacket returns a DHCP request from a client with the given options.
+func testDHCPPacket(msgType byte, opts map[byte][]byte) *dhcpPacket {
+	p := &dhcpPacket{
+		op:      bootRequest,
+		htype:   1,
+		hlen:    6,
+		xid:     0xdeadbeef,
+		options: map[byte][]byte{optMessageType: {msgType}},
+	}
+	copy(p.chaddr[:], []byte{0x00, 0x01, 0x02, 0x03, 0x04, 0x05})
+	for k, v := range opts {
+		p.options[k] = v
+	}
+	return p
+}
+
+func archOpt(a Arch) []byte {
+	b := make([]byte, 2)
+	binary.BigEndian.PutUint16(b, uint16(a))
+	return b
+}
+
+func TestHandleProxyDHCP_Reply(t *testing.T) {
+	h := &HandleProxyDHCP{
+		Log:      logr.Discard(),
+		TFTPAddr: netaddr.MustParseIPPort("192.168.1.10:69"),
+		HTTPAddr: netaddr.MustParseIPPort("192.168.1.10:8080"),
+	}
+	tests := []struct {
+		name string
+		req  *dhcpPacket
+		// port is the port req is received on, ProxyDHCPPort when 0.
+		port          int
+		scriptURL     string
+		wantType      byte
+		wantFile      string
+		wantVendor    string
+		wantErr       error
+		wantVendorOpt bool
+	}{
+		{
+			name:          "bios discover",
+			req:           testDHCPPacket(dhcpDiscover, map[byte][]byte{optVendorClass: []byte("PXEClient:Arch:00000:UNDI:002001"), optClientArch: archOpt(ArchX86BIOS)}),
+			wantType:      dhcpOffer,
+			wantFile:      "undionly.kpxe",
+			wantVendor:    "PXEClient",
+			wantVendorOpt: true,
+		},
+		{
+			name:          "x86_64 efi request",
+			req:           testDHCPPacket(dhcpRequest, map[byte][]byte{optVendorClass: []byte("PXEClient:Arch:00007:UNDI:003016"), optClientArch: archOpt(ArchX64EFIBC)}),
+			port:          PXEPort,
+			wantType:      dhcpAck,
+			wantFile:      "ipxe.efi",
+			wantVendor:    "PXEClient",
+			wantVendorOpt: true,
+		},
+		{
+			name:          "request to the proxydhcp server",
+			req:           testDHCPPacket(dhcpRequest, map[byte][]byte{optVendorClass: []byte("PXEClient:Arch:00007:UNDI:003016"), optClientArch: archOpt(ArchX64EFIBC), optServerID: {192, 168, 1, 10}}),
+			wantType:      dhcpAck,
+			wantFile:      "ipxe.efi",
+			wantVendor:    "PXEClient",
+			wantVendorOpt: true,
+		},
+		{
+			name:    "request to another dhcp server",
+			req:     testDHCPPacket(dhcpRequest, map[byte][]byte{optVendorClass: []byte("PXEClient:Arch:00007:UNDI:003016"), optClientArch: archOpt(ArchX64EFIBC), optServerID: {192, 168, 1, 1}}),
+			wantErr: errOtherServer,
+		},
+		{
+			name:    "inform without server identifier",
+			req:     testDHCPPacket(dhcpInform, map[byte][]byte{optVendorClass: []byte("PXEClient:Arch:00007:UNDI:003016"), optClientArch: archOpt(ArchX64EFIBC)}),
+			wantErr: errOtherServer,
+		},
+		{
+			name:    "discover on the pxe port",
+			req:     testDHCPPacket(dhcpDiscover, map[byte][]byte{optVendorClass: []byte("PXEClient:Arch:00007:UNDI:003016"), optClientArch: archOpt(ArchX64EFIBC)}),
+			port:    PXEPort,
+			wantErr: errAny,
+		},
+		{
+			name:          "arm64 efi discover",
+			req:           testDHCPPacket(dhcpDiscover, map[byte][]byte{optVendorClass: []byte("PXEClient:Arch:00011:UNDI:003000"), optClientArch: archOpt(ArchARM64EFI)}),
+			wantType:      dhcpOffer,
+			wantFile:      "snp.efi",
+			wantVendor:    "PXEClient",
+			wantVendorOpt: true,
+		},
+		{
+			name:       "http boot",
+			req:        testDHCPPacket(dhcpDiscover, map[byte][]byte{optVendorClass: []byte("HTTPClient:Arch:00016:UNDI:003001"), optClientArch: archOpt(ArchX64EFIHTTP)}),
+			wantType:   dhcpOffer,
+			wantFile:   "http://192.168.1.10:8080/ipxe.efi",
+			wantVendor: "HTTPClient",
+		},
+		{
+			name:          "ipxe with script url",
+			req:           testDHCPPacket(dhcpDiscover, map[byte][]byte{optVendorClass: []byte("PXEClient:Arch:00000:UNDI:002001"), optClientArch: archOpt(ArchX86BIOS), optUserClass: []byte("iPXE")}),
+			scriptURL:     "http://192.168.1.10/auto.ipxe",
+			wantType:      dhcpOffer,
+			wantFile:      "http://192.168.1.10/auto.ipxe",
+			wantVendor:    "PXEClient",
+			wantVendorOpt: true,
+		},
+		{
+			name:    "ipxe without script url",
+			req:     testDHCPPacket(dhcpDiscover, map[byte][]byte{optVendorClass: []byte("PXEClient:Arch:00000:UNDI:002001"), optClientArch: archOpt(ArchX86BIOS), optIPXEEncap: {1, 1, 1}}),
+			wantErr: errAny,
+		},
+		{
+			name:    "not a pxe client",
+			req:     testDHCPPacket(dhcpDiscover, map[byte][]byte{optVendorClass: []byte("MSFT 5.0")}),
+			wantErr: errAny,
+		},
+		{
+			name:    "unknown arch",
+			req:     testDHCPPacket(dhcpDiscover, map[byte][]byte{optVendorClass: []byte("PXEClient:Arch:00002:UNDI:002001"), optClientArch: archOpt(2)}),
+			wantErr: errAny,
+		},
+		{
+			name:    "release",
+			req:     testDHCPPacket(7, map[byte][]byte{optVendorClass: []byte("PXEClient:Arch:00000:UNDI:002001"), optClientArch: archOpt(ArchX86BIOS)}),
+			wantErr: errAny,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h.IPXEScriptURL = tt.scriptURL
+			port := tt.port
+			if port == 0 {
+				port = ProxyDHCPPort
+			}
+			got, err := h.reply(tt.req, port)
+			if tt.wantErr != nil {
+				if err == nil || (tt.wantErr != errAny && !errors.Is(err, tt.wantErr)) {
+					t.Fatalf("error mismatch, got: %v, want: %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.messageType() != tt.wantType {
+				t.Fatalf("message type, got: %v, want: %v", got.messageType(), tt.wantType)
+			}
+			if diff := cmp.Diff(string(bytes.TrimRight(got.file[:], "\x00")), tt.wantFile); diff != "" {
+				t.Fatal(diff)
+			}
+			if diff := cmp.Diff(string(got.options[optVendorClass]), tt.wantVendor); diff != "" {
+				t.Fatal(diff)
+			}
+			if _, ok := got.options[optVendorSpecific]; ok != tt.wantVendorOpt {
+				t.Fatalf("vendor specific option present: %v, want: %v", ok, tt.wantVendorOpt)
+			}
+			if got.xid != tt.req.xid || got.chaddr != tt.req.chaddr {
+				t.Fatal("reply does not match the request transaction or client")
+			}
+			if diff := cmp.Diff(got.siaddr, [4]byte{192, 168, 1, 10}); diff != "" {
+				t.Fatal(diff)
+			}
+		})
+	}
+}
+
+// errAny matches any error in table tests.
+var errAny = errors.New("any error")
+
+func TestDHCPPacket_RoundTrip(t *testing.T) {
+	p := testDHCPPacket(dhcpDiscover, map[byte][]byte{
+		optVendorClass:     []byte("PXEClient"),
+		optClientArch:      archOpt(ArchX64EFI),
+		optClientMachineID: bytes.Repeat([]byte{1}, 17),
+		// longer than a single option instance.
+		optUserClass: bytes.Repeat([]byte("a"), 300),
+	})
+	b := p.marshal()
+	got, err := parseDHCP(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(got.options, p.options); diff != "" {
+		t.Fatal(diff)
+	}
+	if diff := cmp.Diff(got.mac().String(), "00:01:02:03:04:05"); diff != "" {
+		t.Fatal(diff)
+	}
+	if _, err := parseDHCP(b[:100]); err == nil {
+		t.Fatal("expected error for a short packet")
+	}
+}
+
+func TestReplyAddr(t *testing.T) {
+	tests := []struct {
+		name   string
+		giaddr [4]byte
+		src    *net.UDPAddr
+		want   *net.UDPAddr
+	}{
+		{name: "broadcast", src: &net.UDPAddr{IP: net.IPv4zero, Port: 68}, want: &net.UDPAddr{IP: net.IPv4bcast, Port: 68}},
+		{name: "relayed", giaddr: [4]byte{10, 0, 0, 1}, src: &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 67}, want: &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1).To4(), Port: 67}},
+		{name: "unicast", src: &net.UDPAddr{IP: net.IPv4(192, 168, 1, 20), Port: 4011}, want: &net.UDPAddr{IP: net.IPv4(192, 168, 1, 20), Port: 4011}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := replyAddr(&dhcpPacket{giaddr: tt.giaddr}, tt.src)
+			if diff := cmp.Diff(got.String(), tt.want.String()); diff != "" {
+				t.Fatal(diff)
+			}
+		})
+	}
+}
+
+func TestHandleProxyDHCP_ReplyDisabled(t *testing.T) {
+	pxe := testDHCPPacket(dhcpDiscover, map[byte][]byte{optVendorClass: []byte("PXEClient:Arch:00007:UNDI:003016"), optClientArch: archOpt(ArchX64EFIBC)})
+	httpBoot := testDHCPPacket(dhcpDiscover, map[byte][]byte{optVendorClass: []byte("HTTPClient:Arch:00016:UNDI:003001"), optClientArch: archOpt(ArchX64EFIHTTP)})
+	tftpOnly := &HandleProxyDHCP{Log: logr.Discard(), TFTPAddr: netaddr.MustParseIPPort("192.168.1.10:69")}
+	httpOnly := &HandleProxyDHCP{Log: logr.Discard(), HTTPAddr: netaddr.MustParseIPPort("192.168.1.10:8080")}
+	tests := []struct {
+		name     string
+		h        *HandleProxyDHCP
+		req      *dhcpPacket
+		wantFile string
+	}{
+		{name: "pxe client without http", h: tftpOnly, req: pxe, wantFile: "ipxe.efi"},
+		{name: "http boot client without http", h: tftpOnly, req: httpBoot},
+		{name: "pxe client without tftp", h: httpOnly, req: pxe},
+		{name: "http boot client without tftp", h: httpOnly, req: httpBoot, wantFile: "http://192.168.1.10:8080/ipxe.efi"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.h.reply(tt.req, ProxyDHCPPort)
+			if tt.wantFile == "" {
+				if err == nil {
+					t.Fatal("expected the client not to be answered")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(string(bytes.TrimRight(got.file[:], "\x00")), tt.wantFile); diff != "" {
+				t.Fatal(diff)
+			}
+			if diff := cmp.Diff(got.siaddr, [4]byte{192, 168, 1, 10}); diff != "" {
+				t.Fatal(diff)
+			}
+		})
+	}
+}
+
+func TestServeProxyDHCP(t *testing.T) {
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	h := &HandleProxyDHCP{Log: logr.Discard(), TFTPAddr: netaddr.MustParseIPPort("127.0.0.1:69")}
+	errCh := make(chan error, 1)
+	go func() { errCh <- ServeProxyDHCP(ctx, conn, h) }()
+
+	client, err := net.Dial("udp4", conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	// requests for another server are ignored.
+	other := testDHCPPacket(dhcpRequest, map[byte][]byte{optVendorClass: []byte("PXEClient:Arch:00009:UNDI:003016"), optClientArch: archOpt(ArchX64EFI), optServerID: {127, 0, 0, 2}})
+	other.xid = 1
+	if _, err := client.Write(other.marshal()); err != nil {
+		t.Fatal(err)
+	}
+	req := testDHCPPacket(dhcpRequest, map[byte][]byte{optVendorClass: []byte("PXEClient:Arch:00009:UNDI:003016"), optClientArch: archOpt(ArchX64EFI), optServerID: {127, 0, 0, 1}})
+	if _, err := client.Write(req.marshal()); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 1500)
+	n, err := client.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := parseDHCP(buf[:n])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.xid != req.xid || got.messageType() != dhcpAck {
+		t.Fatalf("message type, got: %v, want: %v", got.messageType(), dhcpAck)
+	}
+	if diff := cmp.Diff(string(bytes.TrimRight(got.file[:], "\x00")), "ipxe.efi"); diff != "" {
+		t.Fatal(diff)
+	}
+
+	cancel()
+	if err := <-errCh; err != nil {
+		t.Fatal(err)
+	}
+}
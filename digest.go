@@ -0,0 +1,78 @@
+package ipxe
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"io"
+	"sync"
+)
+
+// digestCacheSize is the maximum number of file digests kept by digests.
+const digestCacheSize = 256
+
+// digests caches the digests of the served files, for the ETag of HTTP responses and the manifest.
+var digests = &digestCache{}
+
+// fileDigest holds the hex encoded digests of a file.
+type fileDigest struct {
+	sha256 string
+	sha512 string
+}
+
+// digestKey identifies a version of a file. Files are assumed to change size or
+// modification time when their content changes.
+type digestKey struct {
+	name    string
+	size    int64
+	modTime int64
+}
+
+// digestCache is a bounded cache of file digests. The zero value is ready to use.
+type digestCache struct {
+	mu sync.Mutex
+	m  map[digestKey]fileDigest
+}
+
+// digest returns the digests of f, leaving f at the start of the file. They are only
+// computed when f is not cached. Files with an unknown modification time are never cached,
+// they are hashed every time.
+func (d *digestCache) digest(f *File) (fileDigest, error) {
+	key := digestKey{name: f.Name, size: f.Size, modTime: f.ModTime.UnixNano()}
+	cache := !f.ModTime.IsZero()
+	if cache {
+		d.mu.Lock()
+		fd, ok := d.m[key]
+		d.mu.Unlock()
+		if ok {
+			return fd, nil
+		}
+	}
+
+	s256, s512 := sha256.New(), sha512.New()
+	if _, err := io.Copy(io.MultiWriter(s256, s512), f); err != nil {
+		return fileDigest{}, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return fileDigest{}, err
+	}
+	fd := fileDigest{sha256: hex.EncodeToString(s256.Sum(nil)), sha512: hex.EncodeToString(s512.Sum(nil))}
+	if !cache {
+		return fd, nil
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.m == nil {
+		d.m = make(map[digestKey]fileDigest)
+	}
+	// evict an arbitrary digest, the cache only overflows with many versions of the files.
+	for k := range d.m {
+		if len(d.m) < digestCacheSize {
+			break
+		}
+		delete(d.m, k)
+	}
+	d.m[key] = fd
+	return fd, nil
+}
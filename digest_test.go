@@ -0,0 +1,82 @@
+package ipxe
+
+import (
+	"io"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestDigestCache(t *testing.T) {
+	content := []byte("ipxe")
+	modTime := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name    string
+		modTime []time.Time
+		// wantReads is the number of times the file is read.
+		wantReads int
+	}{
+		{name: "cached", modTime: []time.Time{modTime, modTime, modTime}, wantReads: 1},
+		{name: "modified", modTime: []time.Time{modTime, modTime.Add(time.Second), modTime.Add(time.Second)}, wantReads: 2},
+		{name: "unknown modification time", modTime: []time.Time{{}, {}}, wantReads: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := &digestCache{}
+			reads := 0
+			for _, mt := range tt.modTime {
+				f := NewFile("ipxe.efi", content, mt)
+				f.ReadSeekCloser = &countingReader{ReadSeekCloser: f.ReadSeekCloser, reads: &reads}
+				got, err := d.digest(f)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if diff := cmp.Diff(got.sha512, sha512Hex(content)); diff != "" {
+					t.Fatal(diff)
+				}
+				if diff := cmp.Diff(got.sha256, sha256Hex(content)); diff != "" {
+					t.Fatal(diff)
+				}
+			}
+			if reads != tt.wantReads {
+				t.Fatalf("file read %v times, want: %v", reads, tt.wantReads)
+			}
+		})
+	}
+}
+
+func TestDigestCache_Size(t *testing.T) {
+	d := &digestCache{}
+	modTime := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < digestCacheSize*2; i++ {
+		if _, err := d.digest(NewFile("ipxe.efi", []byte("ipxe"), modTime.Add(time.Duration(i)))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(d.m) != digestCacheSize {
+		t.Fatalf("got %v cached digests, want: %v", len(d.m), digestCacheSize)
+	}
+}
+
+// countingReader is an io.ReadSeekCloser that counts the reads that start at the beginning of the file.
+type countingReader struct {
+	io.ReadSeekCloser
+	reads  *int
+	offset int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	if c.offset == 0 {
+		*c.reads++
+	}
+	n, err := c.ReadSeekCloser.Read(p)
+	c.offset += int64(n)
+	return n, err
+}
+
+func (c *countingReader) Seek(offset int64, whence int) (int64, error) {
+	n, err := c.ReadSeekCloser.Seek(offset, whence)
+	c.offset = n
+	return n, err
+}
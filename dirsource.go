@@ -0,0 +1,158 @@
+package ipxe
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+)
+
+// DirSource is a FileSource that serves the files in a directory on disk.
+//
+// File contents are read into memory when the directory is scanned, so replacing
+// a file on disk never affects transfers that are already in progress. Files should
+// be replaced atomically (write to a temporary name, then rename) so that a scan
+// never picks up a partially written file.
+type DirSource struct {
+	// Dir is the directory to serve files from. Subdirectories are ignored.
+	Dir string
+	// Fallback is consulted for files that are not found in Dir.
+	// Set it to EmbeddedSource() to overlay Dir on top of the embedded iPXE binaries.
+	Fallback FileSource
+	// PollInterval is how often Watch rescans Dir for changes. Defaults to 5 seconds.
+	PollInterval time.Duration
+	// Checksums are the expected digests of the files in Dir. They are checked every time a file is loaded.
+	Checksums Checksums
+	// Verify controls what happens when a file does not match its expected checksum.
+	// With VerifyEnforce the file is not loaded and the previously loaded version, if any, keeps being served.
+	Verify VerifyMode
+	// Log is the logger to use.
+	Log logr.Logger
+
+	mu    sync.RWMutex
+	files map[string]dirFile
+}
+
+type dirFile struct {
+	content []byte
+	modTime time.Time
+}
+
+// Open implements FileSource.
+func (d *DirSource) Open(name string) (*File, error) {
+	d.mu.RLock()
+	f, ok := d.files[name]
+	d.mu.RUnlock()
+	if ok {
+		return NewFile(name, f.content, f.modTime), nil
+	}
+	if d.Fallback != nil {
+		return d.Fallback.Open(name)
+	}
+	return nil, fmt.Errorf("%q: %w", name, os.ErrNotExist)
+}
+
+// List implements FileLister. It includes the files in Fallback when it implements FileLister.
+func (d *DirSource) List() ([]string, error) {
+	seen := map[string]bool{}
+	d.mu.RLock()
+	for name := range d.files {
+		seen[name] = true
+	}
+	d.mu.RUnlock()
+	if l, ok := d.Fallback.(FileLister); ok {
+		names, err := l.List()
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range names {
+			seen[name] = true
+		}
+	}
+	names := make([]string, 0, len(seen))
+	for name := range seen {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// Scan reads Dir and loads any new or changed files.
+// Files that have been removed from Dir are no longer served.
+func (d *DirSource) Scan() error {
+	entries, err := ioutil.ReadDir(d.Dir)
+	if err != nil {
+		return err
+	}
+
+	d.mu.RLock()
+	old := d.files
+	d.mu.RUnlock()
+
+	files := make(map[string]dirFile, len(entries))
+	for _, e := range entries {
+		name := e.Name()
+		// os.Stat follows symlinks, ioutil.ReadDir does not.
+		info, err := os.Stat(filepath.Join(d.Dir, name))
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		if f, ok := old[name]; ok && f.modTime.Equal(info.ModTime()) && int64(len(f.content)) == info.Size() {
+			files[name] = f
+			continue
+		}
+		content, err := ioutil.ReadFile(filepath.Join(d.Dir, name))
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			return err
+		}
+		if err := verifyContent(name, content, d.Checksums, d.Verify, d.Log); err != nil {
+			if f, ok := old[name]; ok {
+				files[name] = f
+			}
+			continue
+		}
+		files[name] = dirFile{content: content, modTime: info.ModTime()}
+		orDiscard(d.Log).Info("loaded file", "dir", d.Dir, "file", name, "size", len(content), "modTime", info.ModTime())
+	}
+	for name := range old {
+		if _, ok := files[name]; !ok {
+			orDiscard(d.Log).Info("removed file", "dir", d.Dir, "file", name)
+		}
+	}
+
+	d.mu.Lock()
+	d.files = files
+	d.mu.Unlock()
+	return nil
+}
+
+// Watch scans Dir every PollInterval until ctx is canceled.
+// Scan errors are logged and the previously loaded files keep being served.
+func (d *DirSource) Watch(ctx context.Context) {
+	interval := d.PollInterval
+	if interval <= 0 {
+		interval = 5 * time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := d.Scan(); err != nil {
+				orDiscard(d.Log).Error(err, "scanning directory failed", "dir", d.Dir)
+			}
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package ipxe
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/jacobweinstock/ipxe/binary"
+)
+
+func TestDirSource_Open(t *testing.T) {
+	dir := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(dir, "ipxe.efi"), []byte("custom ipxe.efi"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name     string
+		fallback FileSource
+		file     string
+		want     []byte
+		wantErr  error
+	}{
+		{name: "from dir", file: "ipxe.efi", want: []byte("custom ipxe.efi")},
+		{name: "overlay", fallback: EmbeddedSource(), file: "ipxe.efi", want: []byte("custom ipxe.efi")},
+		{name: "fallback", fallback: EmbeddedSource(), file: "snp.efi", want: binary.Files["snp.efi"]},
+		{name: "not found", file: "snp.efi", wantErr: os.ErrNotExist},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := &DirSource{Dir: dir, Fallback: tt.fallback}
+			if err := d.Scan(); err != nil {
+				t.Fatal(err)
+			}
+			f, err := d.Open(tt.file)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("error mismatch, got: %v, want: %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			got, err := ioutil.ReadAll(f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(got, tt.want); diff != "" {
+				t.Fatal(diff)
+			}
+		})
+	}
+}
+
+func TestDirSource_Watch(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "snp.efi")
+	if err := ioutil.WriteFile(name, []byte("v1"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	d := &DirSource{Dir: dir, PollInterval: 10 * time.Millisecond}
+	if err := d.Scan(); err != nil {
+		t.Fatal(err)
+	}
+	inflight, err := d.Open("snp.efi")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go d.Watch(ctx)
+
+	if err := ioutil.WriteFile(name, []byte("v2 is longer"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		f, err := d.Open("snp.efi")
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, _ := ioutil.ReadAll(f)
+		if string(got) == "v2 is longer" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("file was not reloaded, got: %q", got)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// a transfer that started before the reload keeps its original content.
+	got, err := ioutil.ReadAll(inflight)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(string(got), "v1"); diff != "" {
+		t.Fatal(diff)
+	}
+
+	if err := os.Remove(name); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Scan(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Open("snp.efi"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("error mismatch, got: %v, want: %v", err, os.ErrNotExist)
+	}
+}
@@ -0,0 +1,157 @@
+package ipxe
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+)
+
+// ErrShuttingDown is returned for transfers refused or aborted by a shutdown.
+var ErrShuttingDown = errors.New("server shutting down")
+
+// Transfers tracks the file transfers in progress of the handlers it is set on, so that a
+// shutdown can wait for them to finish and abort the ones left after a drain timeout.
+// The zero value is ready to use, a nil Transfers tracks nothing.
+type Transfers struct {
+	mu       sync.Mutex
+	active   int
+	draining bool
+	// idle is closed when there are no transfers in progress, nil until there is one.
+	idle chan struct{}
+	// aborted is closed by Abort.
+	aborted chan struct{}
+}
+
+// init must be called with t.mu held.
+func (t *Transfers) init() {
+	if t.aborted == nil {
+		t.aborted = make(chan struct{})
+	}
+}
+
+// begin starts tracking a transfer. It returns ErrShuttingDown once Drain has been called,
+// otherwise a channel closed when the transfer must be aborted and a func that ends it.
+func (t *Transfers) begin() (aborted <-chan struct{}, end func(), err error) {
+	if t == nil {
+		return nil, func() {}, nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.init()
+	if t.draining {
+		return nil, nil, ErrShuttingDown
+	}
+	if t.active == 0 {
+		t.idle = make(chan struct{})
+	}
+	t.active++
+	var once sync.Once
+	return t.aborted, func() { once.Do(t.end) }, nil
+}
+
+func (t *Transfers) end() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.active--
+	if t.active == 0 {
+		close(t.idle)
+	}
+}
+
+// Active returns the number of transfers in progress.
+func (t *Transfers) Active() int {
+	if t == nil {
+		return 0
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.active
+}
+
+// Drain refuses new transfers with ErrShuttingDown.
+func (t *Transfers) Drain() {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.draining = true
+}
+
+// Wait waits until there are no transfers in progress, or ctx is done.
+func (t *Transfers) Wait(ctx context.Context) error {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	idle := t.idle
+	active := t.active
+	t.mu.Unlock()
+	if active == 0 {
+		return nil
+	}
+	select {
+	case <-idle:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Abort makes the transfers in progress fail with ErrShuttingDown on their next read or
+// write, and returns how many there are.
+func (t *Transfers) Abort() int {
+	if t == nil {
+		return 0
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.init()
+	select {
+	case <-t.aborted:
+	default:
+		close(t.aborted)
+	}
+	return t.active
+}
+
+// abortReader is an io.ReadSeekCloser that fails reads once aborted is closed.
+type abortReader struct {
+	io.ReadSeekCloser
+	aborted <-chan struct{}
+}
+
+func (a abortReader) Read(p []byte) (int, error) {
+	select {
+	case <-a.aborted:
+		return 0, ErrShuttingDown
+	default:
+	}
+	return a.ReadSeekCloser.Read(p)
+}
+
+// abortWriterTo is an io.WriterTo whose writes fail once aborted is closed.
+type abortWriterTo struct {
+	io.WriterTo
+	aborted <-chan struct{}
+}
+
+func (a abortWriterTo) WriteTo(w io.Writer) (int64, error) {
+	return a.WriterTo.WriteTo(abortWriter{w: w, aborted: a.aborted})
+}
+
+// abortWriter is an io.Writer that fails writes once aborted is closed.
+type abortWriter struct {
+	w       io.Writer
+	aborted <-chan struct{}
+}
+
+func (a abortWriter) Write(p []byte) (int, error) {
+	select {
+	case <-a.aborted:
+		return 0, ErrShuttingDown
+	default:
+	}
+	return a.w.Write(p)
+}
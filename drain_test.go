@@ -0,0 +1,265 @@
+package ipxe
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/google/go-cmp/cmp"
+	"inet.af/netaddr"
+)
+
+func TestTransfers(t *testing.T) {
+	tr := &Transfers{}
+	if err := tr.Wait(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	aborted, end, err := tr.begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(tr.Active(), 1); diff != "" {
+		t.Fatal(diff)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := tr.Wait(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("error mismatch, got: %v, want: %v", err, context.DeadlineExceeded)
+	}
+
+	tr.Drain()
+	if _, _, err := tr.begin(); !errors.Is(err, ErrShuttingDown) {
+		t.Fatalf("error mismatch, got: %v, want: %v", err, ErrShuttingDown)
+	}
+
+	r := abortReader{ReadSeekCloser: nopCloser{bytes.NewReader([]byte("ipxe"))}, aborted: aborted}
+	if _, err := r.Read(make([]byte, 1)); err != nil {
+		t.Fatal(err)
+	}
+	if n := tr.Abort(); n != 1 {
+		t.Fatalf("got %v aborted transfers, want 1", n)
+	}
+	if _, err := r.Read(make([]byte, 1)); !errors.Is(err, ErrShuttingDown) {
+		t.Fatalf("error mismatch, got: %v, want: %v", err, ErrShuttingDown)
+	}
+	// aborting again is a no-op.
+	tr.Abort()
+
+	end()
+	// ending again is a no-op.
+	end()
+	if diff := cmp.Diff(tr.Active(), 0); diff != "" {
+		t.Fatal(diff)
+	}
+	if err := tr.Wait(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// a nil Transfers tracks nothing.
+	var nilTransfers *Transfers
+	if _, end, err := nilTransfers.begin(); err != nil {
+		t.Fatal(err)
+	} else {
+		end()
+	}
+	nilTransfers.Drain()
+	if n := nilTransfers.Abort(); n != 0 {
+		t.Fatalf("got %v aborted transfers, want 0", n)
+	}
+}
+
+func TestHandleTFTP_Transfers(t *testing.T) {
+	tr := &Transfers{}
+	ht := HandleTFTP{Log: logr.Discard(), Files: MapSource{"ipxe.efi": []byte("ipxe")}, Transfers: tr}
+	rf := &fakeReaderFrom{addr: net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9999}, content: make([]byte, 4)}
+
+	tr.Abort()
+	if err := ht.ReadHandler("ipxe.efi", rf); !errors.Is(err, ErrShuttingDown) {
+		t.Fatalf("error mismatch, got: %v, want: %v", err, ErrShuttingDown)
+	}
+	tr.Drain()
+	if err := ht.ReadHandler("ipxe.efi", rf); !errors.Is(err, ErrShuttingDown) {
+		t.Fatalf("error mismatch, got: %v, want: %v", err, ErrShuttingDown)
+	}
+	if diff := cmp.Diff(tr.Active(), 0); diff != "" {
+		t.Fatal(diff)
+	}
+}
+
+func TestServer_Drain(t *testing.T) {
+	release := make(chan struct{})
+	s, err := NewServer(Config{
+		TFTP:  TFTP{Disabled: true},
+		HTTP:  HTTP{Addr: netaddr.IPPortFrom(netaddr.IPv4(127, 0, 0, 1), 0)},
+		Files: blockingSource{release},
+		Log:   logr.Discard(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	addr := s.HTTPAddr().String()
+
+	type result struct {
+		body []byte
+		err  error
+	}
+	got := make(chan result, 1)
+	go func() {
+		resp, err := http.Get("http://" + addr + "/ipxe.efi")
+		if err != nil {
+			got <- result{err: err}
+			return
+		}
+		defer resp.Body.Close()
+		b, err := ioutil.ReadAll(resp.Body)
+		got <- result{body: b, err: err}
+	}()
+	waitFor(t, func() bool { return s.transfers.Active() == 1 })
+
+	shutdown := make(chan error, 1)
+	go func() { shutdown <- s.Shutdown(context.Background()) }()
+	waitFor(t, func() bool {
+		c, err := net.Dial("tcp", addr)
+		if err == nil {
+			c.Close()
+		}
+		return err != nil
+	})
+
+	// the transfer in progress is finished once it can be.
+	close(release)
+	r := <-got
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+	if diff := cmp.Diff(string(r.body), "ipxe"); diff != "" {
+		t.Fatal(diff)
+	}
+	if err := <-shutdown; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestServer_DrainTimeout(t *testing.T) {
+	var mu sync.Mutex
+	var aborted []interface{}
+	log := logr.New(&captureSink{msg: "aborted transfers still in progress after the drain timeout", fn: func(kv []interface{}) {
+		mu.Lock()
+		defer mu.Unlock()
+		aborted = kv
+	}})
+	s, err := NewServer(Config{
+		TFTP:         TFTP{Disabled: true},
+		HTTP:         HTTP{Addr: netaddr.IPPortFrom(netaddr.IPv4(127, 0, 0, 1), 0)},
+		Files:        slowSource{size: 1 << 20},
+		DrainTimeout: 100 * time.Millisecond,
+		Log:          log,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	got := make(chan error, 1)
+	go func() {
+		resp, err := http.Get("http://" + s.HTTPAddr().String() + "/ipxe.efi")
+		if err != nil {
+			got <- err
+			return
+		}
+		defer resp.Body.Close()
+		_, err = io.Copy(ioutil.Discard, resp.Body)
+		got <- err
+	}()
+	waitFor(t, func() bool { return s.transfers.Active() == 1 })
+
+	if err := s.Shutdown(context.Background()); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("error mismatch, got: %v, want: %v", err, context.DeadlineExceeded)
+	}
+	if err := <-got; err == nil {
+		t.Fatal("expected the transfer to be cut")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if diff := cmp.Diff(aborted, []interface{}{"count", 1}); diff != "" {
+		t.Fatal(diff)
+	}
+}
+
+// waitFor polls cond until it is true, failing the test after 5 seconds.
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	for start := time.Now(); !cond(); time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("timed out waiting for condition")
+		}
+	}
+}
+
+// captureSink is a logr.LogSink that calls fn with the key/values of msg.
+type captureSink struct {
+	msg string
+	fn  func(kv []interface{})
+}
+
+func (c *captureSink) Init(logr.RuntimeInfo) {}
+
+func (c *captureSink) Enabled(int) bool { return true }
+
+func (c *captureSink) Error(error, string, ...interface{}) {}
+
+func (c *captureSink) Info(level int, msg string, kv ...interface{}) {
+	if msg == c.msg {
+		c.fn(kv)
+	}
+}
+
+func (c *captureSink) WithValues(kv ...interface{}) logr.LogSink { return c }
+
+func (c *captureSink) WithName(name string) logr.LogSink { return c }
+
+// slowSource is a FileSource of zeroed files of size bytes that are read slowly, once
+// they have been hashed for their ETag.
+type slowSource struct {
+	size int
+}
+
+func (s slowSource) Open(name string) (*File, error) {
+	f := NewFile(name, make([]byte, s.size), time.Time{})
+	f.ReadSeekCloser = &slowReader{ReadSeekCloser: f.ReadSeekCloser}
+	return f, nil
+}
+
+// slowReader is an io.ReadSeekCloser that reads 1KiB every 10ms after it is first seeked.
+type slowReader struct {
+	io.ReadSeekCloser
+	slow bool
+}
+
+func (s *slowReader) Read(p []byte) (int, error) {
+	if s.slow {
+		time.Sleep(10 * time.Millisecond)
+		if len(p) > 1024 {
+			p = p[:1024]
+		}
+	}
+	return s.ReadSeekCloser.Read(p)
+}
+
+func (s *slowReader) Seek(offset int64, whence int) (int64, error) {
+	s.slow = true
+	return s.ReadSeekCloser.Seek(offset, whence)
+}
@@ -0,0 +1,49 @@
+package ipxe
+
+import (
+	"net/http"
+	"sync/atomic"
+)
+
+// HTTP paths of the health endpoints, served by the HTTP and metrics servers.
+const (
+	// HealthzPath reports whether the process is alive. It always returns 200 OK.
+	HealthzPath = "/healthz"
+	// ReadyzPath returns 200 OK once all the listeners are bound and the files
+	// have been verified, and 503 Service Unavailable before that and during shutdown.
+	ReadyzPath = "/readyz"
+)
+
+// health tracks the readiness of the server for the health endpoints.
+type health struct {
+	ready int32
+}
+
+func (h *health) setReady(ready bool) {
+	var v int32
+	if ready {
+		v = 1
+	}
+	atomic.StoreInt32(&h.ready, v)
+}
+
+func (h *health) isReady() bool {
+	return atomic.LoadInt32(&h.ready) == 1
+}
+
+// healthz handles requests for HealthzPath.
+func (h *health) healthz(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	_, _ = w.Write([]byte("ok\n"))
+}
+
+// readyz handles requests for ReadyzPath.
+func (h *health) readyz(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if !h.isReady() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_, _ = w.Write([]byte("not ready\n"))
+		return
+	}
+	_, _ = w.Write([]byte("ok\n"))
+}
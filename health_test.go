@@ -0,0 +1,102 @@
+package ipxe
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"inet.af/netaddr"
+)
+
+func TestHealth_Readyz(t *testing.T) {
+	h := &health{}
+	tests := []struct {
+		name  string
+		ready bool
+		want  int
+	}{
+		{name: "not ready", want: http.StatusServiceUnavailable},
+		{name: "ready", ready: true, want: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h.setReady(tt.ready)
+			w := httptest.NewRecorder()
+			h.readyz(w, httptest.NewRequest(http.MethodGet, ReadyzPath, nil))
+			if w.Code != tt.want {
+				t.Fatalf("got status %v, want %v", w.Code, tt.want)
+			}
+			w = httptest.NewRecorder()
+			h.healthz(w, httptest.NewRequest(http.MethodGet, HealthzPath, nil))
+			if w.Code != http.StatusOK {
+				t.Fatalf("healthz, got status %v, want %v", w.Code, http.StatusOK)
+			}
+		})
+	}
+}
+
+// freeAddr returns a loopback address with a port that is free for network.
+func freeAddr(t *testing.T, network string) netaddr.IPPort {
+	t.Helper()
+	var addr string
+	switch network {
+	case "udp":
+		c, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		addr = c.LocalAddr().String()
+		c.Close()
+	default:
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		addr = l.Addr().String()
+		l.Close()
+	}
+	return netaddr.MustParseIPPort(addr)
+}
+
+func TestConfig_ServeReadyz(t *testing.T) {
+	c := Config{
+		TFTP: TFTP{Addr: freeAddr(t, "udp")},
+		HTTP: HTTP{Addr: freeAddr(t, "tcp")},
+		Log:  logr.Discard(),
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	errCh := make(chan error, 1)
+	go func() { errCh <- c.Serve(ctx) }()
+
+	url := "http://" + c.HTTP.Addr.String() + ReadyzPath
+	var status int
+	for i := 0; i < 100; i++ {
+		resp, err := http.Get(url)
+		if err == nil {
+			status = resp.StatusCode
+			resp.Body.Close()
+			if status == http.StatusOK {
+				break
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if status != http.StatusOK {
+		t.Fatalf("got status %v, want %v", status, http.StatusOK)
+	}
+
+	cancel()
+	select {
+	case err := <-errCh:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Serve did not return after the context was canceled")
+	}
+}
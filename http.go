@@ -2,21 +2,40 @@ package ipxe
 
 import (
 	"context"
+	"errors"
+	"math"
+	"mime"
 	"net"
 	"net/http"
+	"os"
 	"path"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"unicode/utf8"
 
 	"github.com/go-logr/logr"
-	"github.com/jacobweinstock/ipxe/binary"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 	"inet.af/netaddr"
 )
 
 // HandleHTTP is the struct that implements the http.Handler interface.
 type HandleHTTP struct {
 	Log logr.Logger
+	// Files is the source of files to serve. Defaults to the embedded iPXE binaries.
+	Files FileSource
+	// ACL, when set, controls which clients are served.
+	ACL *ACL
+	// Limits, when set, caps the concurrent transfers and request rate. Requests over
+	// the limits get a 429 Too Many Requests response with a Retry-After header.
+	Limits *Limiter
+	// Transfers, when set, tracks the transfers in progress so a shutdown can drain them.
+	// Requests during a shutdown get a 503 Service Unavailable response.
+	Transfers *Transfers
 }
 
 // ListenAndServeHTTP is a patterned after http.ListenAndServe.
@@ -48,9 +67,78 @@ func trimFirstRune(s string) string {
 	return s[i:]
 }
 
+// contentTypes are the Content-Type headers for served file extensions.
+// Extensions not listed here fall back to mime.TypeByExtension.
+var contentTypes = map[string]string{
+	".efi":   "application/efi",
+	".kpxe":  "application/octet-stream",
+	".kkpxe": "application/octet-stream",
+	".pxe":   "application/octet-stream",
+	".lkrn":  "application/octet-stream",
+	".ipxe":  "text/plain; charset=utf-8",
+}
+
+// contentType returns the Content-Type header for the named file.
+func contentType(name string) string {
+	ext := strings.ToLower(path.Ext(name))
+	if ct, ok := contentTypes[ext]; ok {
+		return ct
+	}
+	if ct := mime.TypeByExtension(ext); ct != "" {
+		return ct
+	}
+	return "application/octet-stream"
+}
+
+// countingWriter is an http.ResponseWriter that records the status code, the number of body bytes written and the first write error.
+type countingWriter struct {
+	http.ResponseWriter
+	status int
+	n      int64
+	err    error
+}
+
+func (c *countingWriter) WriteHeader(status int) {
+	if c.status == 0 {
+		c.status = status
+	}
+	c.ResponseWriter.WriteHeader(status)
+}
+
+func (c *countingWriter) Write(b []byte) (int, error) {
+	if c.status == 0 {
+		c.status = http.StatusOK
+	}
+	n, err := c.ResponseWriter.Write(b)
+	c.n += int64(n)
+	if err != nil && c.err == nil {
+		c.err = err
+	}
+	return n, err
+}
+
+// extractTraceparent returns ctx with the W3C traceparent sent with req, if any.
+// It is taken from the traceparent header, then the traceparent query parameter and then, like
+// TFTP, from the end of the requested filename. The filename is returned without the traceparent.
+func extractTraceparent(ctx context.Context, req *http.Request, filename string) (context.Context, string, error) {
+	tc := propagation.TraceContext{}
+	fctx, short, err := extractTraceparentFromFilename(ctx, filename)
+	if c := tc.Extract(ctx, propagation.HeaderCarrier(req.Header)); trace.SpanContextFromContext(c).IsValid() {
+		return c, short, nil
+	}
+	if tp := req.URL.Query().Get("traceparent"); tp != "" {
+		if c := tc.Extract(ctx, propagation.MapCarrier{"traceparent": tp}); trace.SpanContextFromContext(c).IsValid() {
+			return c, short, nil
+		}
+	}
+	return fctx, short, err
+}
+
 // Handler handles responses to HTTP requests.
+// GET and HEAD requests are supported, including Range and conditional (If-None-Match, If-Modified-Since) requests.
 func (s HandleHTTP) Handler(w http.ResponseWriter, req *http.Request) {
-	if req.Method != "GET" {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
@@ -63,19 +151,99 @@ func (s HandleHTTP) Handler(w http.ResponseWriter, req *http.Request) {
 	mac, _ := net.ParseMAC(m)
 	s.Log = s.Log.WithValues("mac", mac)
 
-	got := filepath.Base(req.URL.Path)
-	file, found := binary.Files[got]
-	if !found {
-		s.Log.Info("could not find file", "file", got)
-		http.NotFound(w, req)
+	longfile := filepath.Base(req.URL.Path)
+	ctx, got, err := extractTraceparent(req.Context(), req, longfile)
+	if err != nil {
+		s.Log.Error(err, "")
+	}
+	ctx, span := otel.Tracer("HTTP").Start(ctx, "HTTP "+req.Method,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(attribute.String("filename", got)),
+		trace.WithAttributes(attribute.String("requested-filename", longfile)),
+		trace.WithAttributes(attribute.String("mac", mac.String())),
+		trace.WithAttributes(attribute.String("IP", host)),
+	)
+	defer span.End()
+	ip, _ := netaddr.ParseIP(host)
+	r := newRequest(ctx, protocolHTTP, got, ip)
+	cw := &countingWriter{ResponseWriter: w}
+	defer func() {
+		span.SetAttributes(attribute.Int64("bytes-sent", cw.n), attribute.Int("status-code", cw.status))
+		outcome := httpOutcome(cw.status)
+		if cw.err != nil {
+			outcome = outcomeError
+		}
+		r.done(outcome, cw.n)
+		switch {
+		case cw.err != nil:
+			span.SetStatus(codes.Error, cw.err.Error())
+		case cw.status >= http.StatusBadRequest:
+			span.SetStatus(codes.Error, http.StatusText(cw.status))
+		default:
+			span.SetStatus(codes.Ok, got)
+		}
+	}()
+
+	if err := s.ACL.Check(ip, mac); err != nil {
+		s.Log.Info("access denied", "reason", err.Error())
+		http.Error(cw, "Forbidden", http.StatusForbidden)
+		return
+	}
+	release, err := s.Limits.acquire(ip, 0)
+	if err != nil {
+		s.Log.Info("request limited", "reason", err.Error())
+		cw.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter(err).Seconds()))))
+		http.Error(cw, "Too Many Requests", http.StatusTooManyRequests)
+		return
+	}
+	defer release()
+	aborted, end, err := s.Transfers.begin()
+	if err != nil {
+		s.Log.Info("transfer refused", "reason", err.Error())
+		http.Error(cw, "Service Unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	defer end()
+
+	ctx = WithClient(ctx, Client{IP: ip, UserAgent: req.UserAgent()})
+	file, err := openFor(ctx, s.Files, got, mac)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			s.Log.Info("could not find file", "file", got)
+			http.NotFound(cw, req)
+			return
+		}
+		s.Log.Error(err, "error opening file", "file", got)
+		span.RecordError(err)
+		cw.WriteHeader(http.StatusInternalServerError)
 		return
 	}
-	b, err := w.Write(file)
+	defer file.Close()
+	file.ReadSeekCloser = abortReader{ReadSeekCloser: file.ReadSeekCloser, aborted: aborted}
+	r.started(file)
+	d, err := digests.digest(file)
 	if err != nil {
-		s.Log.Error(err, "error serving file")
-		w.WriteHeader(http.StatusInternalServerError)
+		s.Log.Error(err, "error reading file", "file", got)
+		span.RecordError(err)
+		cw.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("ETag", `"`+d.sha256+`"`)
+	w.Header().Set("Content-Type", contentType(got))
+	if got == AutoFile {
+		// the same URL resolves to a different binary per client, caches must not share it
+		// and must revalidate it, the ETag then tells whether this client's binary changed.
+		w.Header().Set("Cache-Control", "private, no-cache")
+		w.Header().Set("Vary", "User-Agent")
+	}
+
+	// http.ServeContent handles HEAD, Range, If-Range, If-None-Match and If-Modified-Since.
+	http.ServeContent(cw, req, got, file.ModTime, file)
+	if cw.err != nil {
+		s.Log.Error(cw.err, "error serving file", "bytes sent", cw.n)
+		// the status has already been sent, the error is only recorded.
+		span.RecordError(cw.err)
 		return
 	}
-	s.Log.Info("file served", "bytes sent", b, "content size", len(file), "file", got)
-	w.WriteHeader(http.StatusOK)
+	s.Log.Info("file served", "bytes sent", cw.n, "content size", file.Size, "file", got, "method", req.Method, "range", req.Header.Get("Range"))
 }
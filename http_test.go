@@ -8,11 +8,14 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"path"
 	"testing"
+	"time"
 
 	"github.com/go-logr/logr"
 	"github.com/google/go-cmp/cmp"
 	"github.com/jacobweinstock/ipxe/binary"
+	"go.opentelemetry.io/otel/trace"
 	"inet.af/netaddr"
 )
 
@@ -99,8 +102,9 @@ func TestHandleHTTP_Handler(t *testing.T) {
 		{
 			name: "write failure",
 			req:  req{method: "GET", url: "/snp.efi"},
+			// the status is sent before the body fails to be written.
 			want: &http.Response{
-				StatusCode: http.StatusInternalServerError,
+				StatusCode: http.StatusOK,
 			},
 			failWrite: true,
 		},
@@ -175,3 +179,213 @@ func (r *fakeResponse) Result() *http.Response {
 		Body:       ioutil.NopCloser(bytes.NewBuffer(r.body)),
 	}
 }
+
+func TestHandleHTTP_HandlerConditional(t *testing.T) {
+	content := binary.Files["snp.efi"]
+	h := HandleHTTP{Log: logr.Discard()}
+
+	w := httptest.NewRecorder()
+	h.Handler(w, httptest.NewRequest("GET", "/snp.efi", nil))
+	tag := w.Header().Get("ETag")
+	lastModified := w.Header().Get("Last-Modified")
+	if tag == "" || lastModified == "" {
+		t.Fatalf("missing validators, ETag: %q, Last-Modified: %q", tag, lastModified)
+	}
+
+	tests := []struct {
+		name       string
+		method     string
+		headers    map[string]string
+		wantStatus int
+		wantBody   []byte
+		wantHeader map[string]string
+	}{
+		{
+			name:       "head",
+			method:     "HEAD",
+			wantStatus: http.StatusOK,
+			wantBody:   []byte{},
+			wantHeader: map[string]string{
+				"Content-Length": fmt.Sprint(len(content)),
+				"Content-Type":   "application/efi",
+				"Accept-Ranges":  "bytes",
+			},
+		},
+		{
+			name:       "range",
+			method:     "GET",
+			headers:    map[string]string{"Range": "bytes=10-19"},
+			wantStatus: http.StatusPartialContent,
+			wantBody:   content[10:20],
+			wantHeader: map[string]string{"Content-Range": fmt.Sprintf("bytes 10-19/%d", len(content))},
+		},
+		{
+			name:       "if-none-match",
+			method:     "GET",
+			headers:    map[string]string{"If-None-Match": tag},
+			wantStatus: http.StatusNotModified,
+			wantBody:   []byte{},
+		},
+		{
+			name:       "if-none-match changed",
+			method:     "GET",
+			headers:    map[string]string{"If-None-Match": `"stale"`},
+			wantStatus: http.StatusOK,
+			wantBody:   content,
+		},
+		{
+			name:       "if-modified-since",
+			method:     "GET",
+			headers:    map[string]string{"If-Modified-Since": lastModified},
+			wantStatus: http.StatusNotModified,
+			wantBody:   []byte{},
+		},
+		{
+			name:       "if-range stale",
+			method:     "GET",
+			headers:    map[string]string{"Range": "bytes=10-19", "If-Range": `"stale"`},
+			wantStatus: http.StatusOK,
+			wantBody:   content,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, "/snp.efi", nil)
+			for k, v := range tt.headers {
+				req.Header.Set(k, v)
+			}
+			w := httptest.NewRecorder()
+			h.Handler(w, req)
+			resp := w.Result()
+			defer resp.Body.Close()
+			if diff := cmp.Diff(resp.StatusCode, tt.wantStatus); diff != "" {
+				t.Fatal(diff)
+			}
+			got, err := ioutil.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(got, tt.wantBody); diff != "" {
+				t.Fatal(diff)
+			}
+			for k, v := range tt.wantHeader {
+				if diff := cmp.Diff(resp.Header.Get(k), v); diff != "" {
+					t.Fatalf("%v: %v", k, diff)
+				}
+			}
+		})
+	}
+}
+
+func TestContentType(t *testing.T) {
+	tests := map[string]string{
+		"ipxe.efi":      "application/efi",
+		"undionly.kpxe": "application/octet-stream",
+		"auto.ipxe":     "text/plain; charset=utf-8",
+		"unknown":       "application/octet-stream",
+	}
+	for name, want := range tests {
+		if diff := cmp.Diff(contentType(name), want); diff != "" {
+			t.Errorf("%v: %v", name, diff)
+		}
+	}
+}
+
+func TestExtractTraceparent(t *testing.T) {
+	const (
+		header = "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"
+		query  = "00-1af7651916cd43dd8448eb211c80319c-c7ad6b7169203331-01"
+		suffix = "00-2af7651916cd43dd8448eb211c80319c-d7ad6b7169203331-01"
+	)
+	tests := []struct {
+		name      string
+		url       string
+		header    string
+		wantTrace string
+		wantFile  string
+	}{
+		{name: "none", url: "/ipxe.efi", wantFile: "ipxe.efi"},
+		{name: "header", url: "/ipxe.efi", header: header, wantTrace: "0af7651916cd43dd8448eb211c80319c", wantFile: "ipxe.efi"},
+		{name: "query", url: "/ipxe.efi?traceparent=" + query, wantTrace: "1af7651916cd43dd8448eb211c80319c", wantFile: "ipxe.efi"},
+		{name: "filename", url: "/ipxe.efi-" + suffix, wantTrace: "2af7651916cd43dd8448eb211c80319c", wantFile: "ipxe.efi"},
+		{name: "header wins", url: "/ipxe.efi-" + suffix + "?traceparent=" + query, header: header, wantTrace: "0af7651916cd43dd8448eb211c80319c", wantFile: "ipxe.efi"},
+		{name: "invalid header", url: "/ipxe.efi?traceparent=" + query, header: "nope", wantTrace: "1af7651916cd43dd8448eb211c80319c", wantFile: "ipxe.efi"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tt.url, nil)
+			if tt.header != "" {
+				req.Header.Set("traceparent", tt.header)
+			}
+			ctx, file, err := extractTraceparent(context.Background(), req, path.Base(req.URL.Path))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(file, tt.wantFile); diff != "" {
+				t.Fatal(diff)
+			}
+			sc := trace.SpanContextFromContext(ctx)
+			if tt.wantTrace == "" {
+				if sc.IsValid() {
+					t.Fatalf("unexpected span context %v", sc.TraceID())
+				}
+				return
+			}
+			if diff := cmp.Diff(sc.TraceID().String(), tt.wantTrace); diff != "" {
+				t.Fatal(diff)
+			}
+			if !sc.IsRemote() {
+				t.Fatal("expected a remote span context")
+			}
+		})
+	}
+}
+
+func TestHandleHTTP_HandlerStatus(t *testing.T) {
+	h := HandleHTTP{Log: logr.Discard(), Files: MapSource{"ipxe.efi": []byte("ipxe")}}
+	tests := []struct {
+		url  string
+		want int
+	}{
+		{url: "/ipxe.efi-00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01", want: http.StatusOK},
+		{url: "/missing.efi", want: http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.url, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			h.Handler(w, httptest.NewRequest(http.MethodGet, tt.url, nil))
+			if w.Code != tt.want {
+				t.Fatalf("got status %v, want %v", w.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestHandleHTTP_HandlerETagCached(t *testing.T) {
+	reads := 0
+	// digests is shared, a new modification time keeps the file out of it when the test is repeated.
+	modTime := time.Now()
+	h := HandleHTTP{Log: logr.Discard(), Files: fileSourceFunc(func(name string) (*File, error) {
+		f := NewFile(name, []byte("etag cached content"), modTime)
+		f.ReadSeekCloser = &countingReader{ReadSeekCloser: f.ReadSeekCloser, reads: &reads}
+		return f, nil
+	})}
+	var tags []string
+	for _, rng := range []string{"bytes=1-2", "bytes=3-4", "bytes=5-6"} {
+		req := httptest.NewRequest("GET", "/etag-cached.efi", nil)
+		req.Header.Set("Range", rng)
+		w := httptest.NewRecorder()
+		h.Handler(w, req)
+		if w.Code != http.StatusPartialContent {
+			t.Fatalf("got status %v, want %v", w.Code, http.StatusPartialContent)
+		}
+		tags = append(tags, w.Header().Get("ETag"))
+	}
+	if tags[0] == "" || tags[0] != tags[1] || tags[1] != tags[2] {
+		t.Fatalf("ETag mismatch: %v", tags)
+	}
+	// only the first request hashes the whole file, range requests read from their offset.
+	if reads != 1 {
+		t.Fatalf("file read from the start %v times, want: 1", reads)
+	}
+}
@@ -4,15 +4,12 @@ package ipxe
 import (
 	"context"
 	"errors"
-	"fmt"
 	"net/http"
 	"reflect"
 	"time"
 
 	"github.com/go-logr/logr"
-	"github.com/imdario/mergo"
 	"github.com/pin/tftp"
-	"golang.org/x/sync/errgroup"
 	"inet.af/netaddr"
 )
 
@@ -22,24 +19,165 @@ type Config struct {
 	TFTP TFTP
 	// HTTP holds the details for the HTTP server.
 	HTTP HTTP
+	// ProxyDHCP holds the details for the optional proxyDHCP server.
+	ProxyDHCP ProxyDHCP
+	// Metrics holds the details for the optional Prometheus metrics server.
+	Metrics Metrics
+	// Files is the source of files served over TFTP and HTTP.
+	// Defaults to the iPXE binaries embedded in the binary package.
+	Files FileSource
+	// EmbeddedScript, when set, is patched into the embedded script region of the served
+	// iPXE binaries, replacing the script they were built with. See binary.Patch.
+	EmbeddedScript []byte
+	// Verify controls what Serve does when a served file does not match its expected checksum.
+	// The default, VerifyEnforce, refuses to start.
+	Verify VerifyMode
+	// Checksums are the expected digests of the files in Files. The embedded iPXE binaries are
+	// always checked against binary.Checksums. When Files implements FileLister, the digest of
+	// every file it lists is checked against Checksums and logged on start up.
+	Checksums Checksums
+	// Scripts, when set, looks up a per machine iPXE script to patch into the served iPXE
+	// binaries. The MAC address of a machine is taken from the request path, for example
+	// "aa:bb:cc:dd:ee:ff/ipxe.efi". Machines without a script get EmbeddedScript.
+	Scripts ScriptLookup
+	// Auto holds the details for serving AutoFile.
+	Auto AutoSelect
+	// ACL, when set, controls which clients are served over TFTP and HTTP.
+	ACL *ACL
+	// DrainTimeout is how long a shutdown waits for the transfers in progress to finish,
+	// once the servers stop accepting new ones. Transfers still in progress after it are
+	// aborted. Defaults to 30 seconds.
+	DrainTimeout time.Duration
 	// Log is the logger to use.
 	Log logr.Logger
 }
 
 // TFTP is the configuration for the TFTP server.
 type TFTP struct {
+	// Disabled turns the TFTP server off.
+	Disabled bool
 	// Addr is the address:port to listen on for TFTP requests.
 	Addr netaddr.IPPort
 	// Timeout is the timeout for serving TFTP files.
 	Timeout time.Duration
+	// MaxRetries is the maximum number of attempts to transmit a packet. Defaults to 5.
+	MaxRetries int
+	// Backoff returns how long to wait before retransmitting an unacknowledged packet, by
+	// attempt. Defaults to a random duration of up to one second. See ParseBackoff.
+	Backoff func(attempt int) time.Duration
+	// BlockSize is the maximum block size negotiated with clients, between 512 and 65464.
+	// The negotiated size is also limited by the MTU of the interface. Defaults to no limit.
+	BlockSize int
+	// WindowSize is the maximum number of blocks sent before waiting for an acknowledgement,
+	// negotiated with clients that request the RFC 7440 windowsize option. Values above 1
+	// serve octet mode read requests with a windowed sender instead of pin/tftp's, except in
+	// single port mode. pin/tftp then serves uploads and netascii reads with blocks of at most
+	// 512 bytes, from an address the routing table picks, see windowServer. Defaults to 1, lock-step.
+	WindowSize int
+	// SinglePort serves all transfers from the listen port, instead of a new port per transfer.
+	// Some NAT and firewall setups need it, it is slower.
+	SinglePort bool
+	// Uploads, when set, accepts files uploaded by clients. By default write requests are refused.
+	Uploads *Uploads
+	// Limits, when set, caps the concurrent transfers and request rate of read and write requests.
+	// Requests over the limits wait up to Limits.QueueTimeout, then get an error the client can retry.
+	Limits *Limiter
+}
+
+// configure applies the TFTP tuning to s.
+func (t TFTP) configure(s *tftp.Server) {
+	s.SetTimeout(t.Timeout)
+	s.SetRetries(t.MaxRetries)
+	if t.Backoff != nil {
+		s.SetBackoff(t.Backoff)
+	}
+	s.SetBlockSize(t.BlockSize)
+	// must be after SetBlockSize, single port mode sizes its buffers by the block size.
+	if t.SinglePort {
+		s.EnableSinglePort()
+	}
+}
+
+// windowed reports whether read requests are served by a windowServer.
+func (t TFTP) windowed() bool {
+	return t.WindowSize > 1 && !t.SinglePort
 }
 
 // HTTP is the configuration for the HTTP server.
 type HTTP struct {
+	// Disabled turns the HTTP server off, including the manifest and health endpoints.
+	Disabled bool
 	//  Addr is the address:port to listen on.
 	Addr netaddr.IPPort
 	// Timeout is the timeout for serving HTTP files.
+	// It is the default for ReadTimeout and ReadHeaderTimeout.
 	Timeout time.Duration
+	// ReadTimeout is the maximum duration for reading an entire request. Defaults to Timeout.
+	ReadTimeout time.Duration
+	// ReadHeaderTimeout is the maximum duration for reading request headers. Defaults to Timeout.
+	ReadHeaderTimeout time.Duration
+	// WriteTimeout is the maximum duration for writing a response. Defaults to 1 minute.
+	WriteTimeout time.Duration
+	// IdleTimeout is the maximum duration to wait for the next request on a keep-alive
+	// connection. Defaults to 2 minutes.
+	IdleTimeout time.Duration
+	// MaxConns is the maximum number of concurrent connections. Further connections wait
+	// to be accepted. Defaults to 0, no limit.
+	MaxConns int
+	// MaxHeaderBytes is the maximum size of request headers.
+	// Defaults to 0, which uses http.DefaultMaxHeaderBytes.
+	MaxHeaderBytes int
+	// Limits, when set, caps the concurrent transfers and request rate of file requests.
+	// Requests over the limits get a 429 Too Many Requests response.
+	Limits *Limiter
+}
+
+// server returns an http.Server for handler with the configured timeouts and limits.
+func (h HTTP) server(handler http.Handler) *http.Server {
+	return &http.Server{
+		Handler:           handler,
+		ReadTimeout:       h.ReadTimeout,
+		ReadHeaderTimeout: h.ReadHeaderTimeout,
+		WriteTimeout:      h.WriteTimeout,
+		IdleTimeout:       h.IdleTimeout,
+		MaxHeaderBytes:    h.MaxHeaderBytes,
+	}
+}
+
+// ProxyDHCP is the configuration for the proxyDHCP server.
+// It answers PXE clients with the iPXE binary for their architecture, pointing them at the
+// TFTP server or, for UEFI HTTP Boot clients, the HTTP server. Another DHCP server on the
+// network must still hand out IP addresses. It needs TFTP, when HTTP is disabled UEFI HTTP
+// Boot clients are not answered.
+type ProxyDHCP struct {
+	// Enabled starts the proxyDHCP server on ports 67 and 4011.
+	Enabled bool
+	// Addr is the IP to listen on. Defaults to 0.0.0.0, which is needed to receive broadcasts.
+	Addr netaddr.IP
+	// PublicIP is the IP clients are told to fetch boot files from.
+	// Defaults to the TFTP listen IP, it must be set when TFTP listens on all interfaces.
+	PublicIP netaddr.IP
+	// IPXEScriptURL is the boot filename handed to clients that are already running iPXE.
+	// When empty those clients are not answered.
+	IPXEScriptURL string
+}
+
+// Metrics is the configuration for the Prometheus metrics server.
+type Metrics struct {
+	// Addr is the address:port to serve metrics on, at MetricsPath, along with the health
+	// endpoints at HealthzPath and ReadyzPath.
+	// When zero, metrics are only registered with the default Prometheus registry.
+	Addr netaddr.IPPort
+}
+
+// AutoSelect is the configuration for AutoFile, which resolves to the iPXE binary for the
+// architecture of the machine requesting it. See AutoSource.
+type AutoSelect struct {
+	// Overrides are the file names to serve for AutoFile, by MAC address.
+	Overrides map[string]string
+	// Default is the file served for AutoFile when the architecture of a machine is unknown.
+	// When empty, such requests fail with file not found.
+	Default string
 }
 
 type ipport netaddr.IPPort
@@ -47,65 +185,45 @@ type ipport netaddr.IPPort
 type logger logr.Logger
 
 // Serve will listen and serve iPXE binaries over TFTP and HTTP.
-// See binary/binary.go for the iPXE files that are served.
+// Either server can be disabled, but not both.
+// Files are served from c.Files, see binary/binary.go for the iPXE files that are served by default.
+// It blocks until ctx is canceled or a server fails and the transfers in progress are drained,
+// see Config.DrainTimeout. See Server to serve in the background.
 func (c Config) Serve(ctx context.Context) error {
-	defaults := Config{
-		TFTP: TFTP{Addr: netaddr.IPPortFrom(netaddr.IPv4(0, 0, 0, 0), 69), Timeout: 5 * time.Second},
-		HTTP: HTTP{Addr: netaddr.IPPortFrom(netaddr.IPv4(0, 0, 0, 0), 8080), Timeout: 5 * time.Second},
-		Log:  logr.Discard(),
-	}
-	err := mergo.Merge(&c, defaults, mergo.WithTransformers(ipport{}), mergo.WithTransformers(logger{}))
+	s, err := NewServer(c)
 	if err != nil {
 		return err
 	}
-
-	t := &HandleTFTP{Log: c.Log}
-	st := tftp.NewServer(t.ReadHandler, t.WriteHandler)
-	st.SetTimeout(c.TFTP.Timeout)
-	g, ctx := errgroup.WithContext(ctx)
-	var tftpErr error
-	g.Go(func() error {
-		c.Log.Info("serving TFTP", "addr", c.TFTP.Addr, "timeout", c.TFTP.Timeout)
-		if err := ListenAndServeTFTP(ctx, c.TFTP.Addr, st); err != nil {
-			tftpErr = fmt.Errorf("tftp serve error: %w", err)
-			return tftpErr
-		}
-		return nil
-	})
-
-	router := http.NewServeMux()
-	s := HandleHTTP{Log: c.Log}
-	router.HandleFunc("/", s.Handler)
-
-	srv := &http.Server{
-		Handler: router,
+	if err := s.Start(ctx); err != nil {
+		return err
 	}
+	<-s.Done()
+	return s.Err()
+}
 
-	var httpErr error
-	g.Go(func() error {
-		c.Log.Info("serving HTTP", "addr", c.HTTP.Addr, "timeout", c.HTTP.Timeout)
-		if err := ListenAndServeHTTP(ctx, c.HTTP.Addr, srv); err != nil && !errors.Is(err, http.ErrServerClosed) {
-			httpErr = fmt.Errorf("http serve error: %w", err)
-			return httpErr
-		}
-		return nil
-	})
-
-	// errgroup.WithContext: The derived Context is canceled the first time a function
-	// passed to Go returns a non-nil error or the first time Wait returns, whichever occurs first.
-	<-ctx.Done()
-
-	// Don't shutdown if the TFTP server failed, this will cause an immediate program exit without a stacktrace.
-	if tftpErr == nil {
-		st.Shutdown()
+// proxyDHCPHandler returns the proxyDHCP handler pointing clients at the TFTP server and,
+// unless it is disabled, the HTTP server. The architecture of clients is recorded in archs.
+func (c Config) proxyDHCPHandler(archs *ArchCache) (*HandleProxyDHCP, error) {
+	if c.TFTP.Disabled {
+		return nil, errors.New("proxyDHCP needs TFTP, PXE clients fetch the iPXE binaries over it")
 	}
-	// Don't shutdown if the HTTP server failed, this will cause an immediate program exit without a stacktrace.
-	if httpErr == nil {
-		_ = srv.Shutdown(ctx)
+	ip := c.ProxyDHCP.PublicIP
+	if ip.IsZero() {
+		ip = c.TFTP.Addr.IP()
 	}
-	c.Log.Info("shutting down")
-
-	return g.Wait()
+	if ip.IsZero() || ip.IsUnspecified() || !ip.Is4() {
+		return nil, errors.New("proxyDHCP needs a public IPv4 address when TFTP listens on all interfaces")
+	}
+	h := &HandleProxyDHCP{
+		Log:           c.Log.WithName("proxydhcp"),
+		TFTPAddr:      netaddr.IPPortFrom(ip, c.TFTP.Addr.Port()),
+		IPXEScriptURL: c.ProxyDHCP.IPXEScriptURL,
+		Archs:         archs,
+	}
+	if !c.HTTP.Disabled {
+		h.HTTPAddr = netaddr.IPPortFrom(ip, c.HTTP.Addr.Port())
+	}
+	return h, nil
 }
 
 func (l logger) Transformer(typ reflect.Type) func(dst, src reflect.Value) error {
@@ -0,0 +1,187 @@
+package ipxe
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"inet.af/netaddr"
+)
+
+func TestConfig_ServeHTTPLimits(t *testing.T) {
+	c := Config{
+		TFTP: TFTP{Addr: freeAddr(t, "udp")},
+		HTTP: HTTP{Addr: freeAddr(t, "tcp"), ReadHeaderTimeout: 100 * time.Millisecond, MaxConns: 1},
+		Log:  logr.Discard(),
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	errCh := make(chan error, 1)
+	go func() { errCh <- c.Serve(ctx) }()
+	defer func() {
+		cancel()
+		<-errCh
+	}()
+
+	var conn net.Conn
+	var err error
+	for i := 0; i < 100; i++ {
+		if conn, err = net.Dial("tcp", c.HTTP.Addr.String()); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// the only connection allowed is held open without sending a request, so others are not served.
+	client := &http.Client{Timeout: 50 * time.Millisecond}
+	if resp, err := client.Get("http://" + c.HTTP.Addr.String() + HealthzPath); err == nil {
+		resp.Body.Close()
+		t.Fatal("expected a second connection not to be served")
+	}
+
+	// the idle connection is closed once the header timeout passes.
+	if err := conn.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Fatal("expected the connection to be closed")
+	}
+	client.Timeout = 5 * time.Second
+	resp, err := client.Get("http://" + c.HTTP.Addr.String() + HealthzPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+}
+
+func TestConfig_ServeTFTPSinglePort(t *testing.T) {
+	c := Config{
+		TFTP: TFTP{Addr: freeAddr(t, "udp"), SinglePort: true, BlockSize: 1024, WindowSize: 4},
+		HTTP: HTTP{Addr: freeAddr(t, "tcp")},
+		Log:  logr.Discard(),
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	errCh := make(chan error, 1)
+	go func() { errCh <- c.Serve(ctx) }()
+	time.Sleep(100 * time.Millisecond)
+
+	cancel()
+	select {
+	case err := <-errCh:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Serve did not return after the context was canceled")
+	}
+}
+
+func TestConfig_ServeDisabled(t *testing.T) {
+	c := Config{
+		TFTP: TFTP{Addr: freeAddr(t, "udp"), Disabled: true},
+		HTTP: HTTP{Addr: freeAddr(t, "tcp"), Disabled: true},
+		Log:  logr.Discard(),
+	}
+	if err := c.Serve(context.Background()); err == nil {
+		t.Fatal("expected an error with both servers disabled")
+	}
+
+	tests := []struct {
+		name         string
+		tftpDisabled bool
+		httpDisabled bool
+	}{
+		{name: "tftp disabled", tftpDisabled: true},
+		{name: "http disabled", httpDisabled: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := Config{
+				TFTP: TFTP{Addr: freeAddr(t, "udp"), Disabled: tt.tftpDisabled},
+				HTTP: HTTP{Addr: freeAddr(t, "tcp"), Disabled: tt.httpDisabled},
+				Log:  logr.Discard(),
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			errCh := make(chan error, 1)
+			go func() { errCh <- c.Serve(ctx) }()
+			defer func() {
+				cancel()
+				if err := <-errCh; err != nil {
+					t.Fatal(err)
+				}
+			}()
+			time.Sleep(100 * time.Millisecond)
+
+			// the address of a disabled server is free, the other is bound.
+			tconn, terr := net.ListenPacket("udp", c.TFTP.Addr.String())
+			if terr == nil {
+				tconn.Close()
+			}
+			if (terr == nil) != tt.tftpDisabled {
+				t.Fatalf("binding the tftp addr, got err: %v, want free: %v", terr, tt.tftpDisabled)
+			}
+			hconn, herr := net.Listen("tcp", c.HTTP.Addr.String())
+			if herr == nil {
+				hconn.Close()
+			}
+			if (herr == nil) != tt.httpDisabled {
+				t.Fatalf("binding the http addr, got err: %v, want free: %v", herr, tt.httpDisabled)
+			}
+		})
+	}
+}
+
+func TestConfig_ProxyDHCPHandler(t *testing.T) {
+	public := netaddr.MustParseIP("192.168.2.1")
+	tests := []struct {
+		name     string
+		c        Config
+		wantTFTP netaddr.IPPort
+		wantHTTP netaddr.IPPort
+		wantErr  bool
+	}{
+		{
+			name:     "tftp and http",
+			c:        Config{TFTP: TFTP{Addr: netaddr.MustParseIPPort("192.168.2.1:69")}, HTTP: HTTP{Addr: netaddr.MustParseIPPort("0.0.0.0:8080")}},
+			wantTFTP: netaddr.IPPortFrom(public, 69),
+			wantHTTP: netaddr.IPPortFrom(public, 8080),
+		},
+		{
+			name:     "http disabled",
+			c:        Config{TFTP: TFTP{Addr: netaddr.MustParseIPPort("192.168.2.1:69")}, HTTP: HTTP{Addr: netaddr.MustParseIPPort("0.0.0.0:8080"), Disabled: true}},
+			wantTFTP: netaddr.IPPortFrom(public, 69),
+		},
+		{
+			name:    "tftp disabled",
+			c:       Config{TFTP: TFTP{Addr: netaddr.MustParseIPPort("192.168.2.1:69"), Disabled: true}, HTTP: HTTP{Addr: netaddr.MustParseIPPort("192.168.2.1:8080")}},
+			wantErr: true,
+		},
+		{
+			name:    "tftp on all interfaces",
+			c:       Config{TFTP: TFTP{Addr: netaddr.MustParseIPPort("0.0.0.0:69")}, HTTP: HTTP{Addr: netaddr.MustParseIPPort("192.168.2.1:8080")}},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.c.ProxyDHCP.Enabled = true
+			tt.c.Log = logr.Discard()
+			h, err := tt.c.proxyDHCPHandler(&ArchCache{})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got err: %v, want err: %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if h.TFTPAddr != tt.wantTFTP || h.HTTPAddr != tt.wantHTTP {
+				t.Fatalf("got tftp %v http %v, want tftp %v http %v", h.TFTPAddr, h.HTTPAddr, tt.wantTFTP, tt.wantHTTP)
+			}
+		})
+	}
+}
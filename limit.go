@@ -0,0 +1,255 @@
+package ipxe
+
+import (
+	"errors"
+	"math"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+	"inet.af/netaddr"
+)
+
+// ErrLimited is wrapped by the errors returned for requests over the limits of a Limiter.
+var ErrLimited = errors.New("too many requests")
+
+// defaultRetryAfter is how long clients are told to wait when Limiter.RetryAfter is not set.
+const defaultRetryAfter = time.Second
+
+// defaultQueueTimeout is how long TFTP requests wait for the limits when Limiter.QueueTimeout is not set.
+const defaultQueueTimeout = 3 * time.Second
+
+// minClientIdle is the least time a client without transfers in progress is remembered.
+const minClientIdle = time.Minute
+
+// Limiter caps the number of concurrent transfers and the rate of requests, in total and
+// per client IP. The zero value has no limits. A Limiter must not be copied after first use.
+type Limiter struct {
+	// MaxTransfers is the maximum number of concurrent transfers, 0 means no limit.
+	MaxTransfers int
+	// MaxClientTransfers is the maximum number of concurrent transfers of a client, 0 means no limit.
+	MaxClientTransfers int
+	// Rate is the maximum number of requests per second, 0 means no limit.
+	Rate float64
+	// Burst is the number of requests allowed at once above Rate. Defaults to Rate rounded up.
+	Burst int
+	// ClientRate is the maximum number of requests per second of a client, 0 means no limit.
+	ClientRate float64
+	// ClientBurst is the number of requests of a client allowed at once above ClientRate.
+	// Defaults to ClientRate rounded up.
+	ClientBurst int
+	// QueueTimeout is how long a TFTP request over the limits waits for them before it is
+	// refused. A refused client gets a TFTP error, which iPXE and PXE ROMs do not retry, so it
+	// should leave time for transfers in progress to finish. HTTP requests are never queued.
+	// Defaults to 3 seconds, a negative value means no waiting.
+	QueueTimeout time.Duration
+	// RetryAfter is how long HTTP clients are told to wait when there are too many transfers
+	// in progress. Rate limited requests are told how long until they are allowed. Defaults to 1 second.
+	RetryAfter time.Duration
+
+	mu       sync.Mutex
+	rate     *rate.Limiter
+	clients  map[netaddr.IP]*clientLimit
+	active   int
+	released chan struct{}
+	purged   time.Time
+}
+
+// clientLimit is the state of the limits of a client.
+type clientLimit struct {
+	rate   *rate.Limiter
+	active int
+	// waiting is the number of requests of the client waiting for the limits.
+	waiting int
+	seen    time.Time
+}
+
+// limitError is returned for requests over the limits.
+type limitError struct {
+	reason     string
+	retryAfter time.Duration
+}
+
+func (e *limitError) Error() string { return e.reason + ": " + ErrLimited.Error() }
+
+func (e *limitError) Unwrap() error { return ErrLimited }
+
+// retryAfter returns how long the client of a request refused with err should wait before trying again.
+func retryAfter(err error) time.Duration {
+	var le *limitError
+	if errors.As(err, &le) && le.retryAfter > 0 {
+		return le.retryAfter
+	}
+	return defaultRetryAfter
+}
+
+// queueTimeout returns how long TFTP requests wait for the limits, 0 for a nil Limiter.
+func (l *Limiter) queueTimeout() time.Duration {
+	switch {
+	case l == nil || l.QueueTimeout < 0:
+		return 0
+	case l.QueueTimeout == 0:
+		return defaultQueueTimeout
+	}
+	return l.QueueTimeout
+}
+
+// orNew returns l when n has the same limits, otherwise n.
+func (l *Limiter) orNew(n *Limiter) *Limiter {
+	if l == nil || n == nil {
+		return n
+	}
+	if l.MaxTransfers == n.MaxTransfers && l.MaxClientTransfers == n.MaxClientTransfers &&
+		l.Rate == n.Rate && l.Burst == n.Burst && l.ClientRate == n.ClientRate && l.ClientBurst == n.ClientBurst &&
+		l.QueueTimeout == n.QueueTimeout && l.RetryAfter == n.RetryAfter {
+		return l
+	}
+	return n
+}
+
+// newRateLimiter returns a rate.Limiter for r requests per second, nil when r is not positive.
+func newRateLimiter(r float64, burst int) *rate.Limiter {
+	if r <= 0 {
+		return nil
+	}
+	if burst <= 0 {
+		burst = int(math.Ceil(r))
+	}
+	return rate.NewLimiter(rate.Limit(r), burst)
+}
+
+// acquire takes a transfer slot for ip, waiting up to wait when the limits are reached.
+// The returned release func must be called once the transfer is done. A nil Limiter has no limits.
+func (l *Limiter) acquire(ip netaddr.IP, wait time.Duration) (release func(), err error) {
+	if l == nil {
+		return func() {}, nil
+	}
+	ip = ip.Unmap()
+	deadline := time.Now().Add(wait)
+
+	l.mu.Lock()
+	if l.clients == nil {
+		l.rate = newRateLimiter(l.Rate, l.Burst)
+		l.clients = map[netaddr.IP]*clientLimit{}
+		l.released = make(chan struct{})
+	}
+	l.purge()
+	c, ok := l.clients[ip]
+	if !ok {
+		c = &clientLimit{rate: newRateLimiter(l.ClientRate, l.ClientBurst)}
+		l.clients[ip] = c
+	}
+	c.seen = time.Now()
+	// a client with waiting requests is not purged, they would not count against its limits.
+	c.waiting++
+	err = l.reserve(c, wait)
+	if err != nil {
+		c.waiting--
+	}
+	l.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		l.mu.Lock()
+		switch {
+		case l.MaxTransfers > 0 && l.active >= l.MaxTransfers:
+			err = &limitError{reason: "too many transfers in progress", retryAfter: l.RetryAfter}
+		case l.MaxClientTransfers > 0 && c.active >= l.MaxClientTransfers:
+			err = &limitError{reason: "too many transfers in progress for " + ip.String(), retryAfter: l.RetryAfter}
+		default:
+			c.waiting--
+			l.active++
+			c.active++
+			l.mu.Unlock()
+			var once sync.Once
+			return func() { once.Do(func() { l.release(c) }) }, nil
+		}
+		released := l.released
+		left := time.Until(deadline)
+		if left <= 0 {
+			c.waiting--
+			l.mu.Unlock()
+			return nil, err
+		}
+		l.mu.Unlock()
+
+		t := time.NewTimer(left)
+		select {
+		case <-released:
+			t.Stop()
+		case <-t.C:
+		}
+	}
+}
+
+// reserve takes a request from the rate limits of the Limiter and c, sleeping when the
+// request is allowed within wait. l.mu must be held, it is released while sleeping.
+func (l *Limiter) reserve(c *clientLimit, wait time.Duration) error {
+	now := time.Now()
+	var delay time.Duration
+	var rs []*rate.Reservation
+	for _, r := range []*rate.Limiter{l.rate, c.rate} {
+		if r == nil {
+			continue
+		}
+		res := r.ReserveN(now, 1)
+		rs = append(rs, res)
+		if !res.OK() {
+			delay = rate.InfDuration
+			continue
+		}
+		if d := res.DelayFrom(now); d > delay {
+			delay = d
+		}
+	}
+	if delay == 0 {
+		return nil
+	}
+	if delay > wait {
+		for _, res := range rs {
+			res.CancelAt(now)
+		}
+		return &limitError{reason: "request rate exceeded", retryAfter: delay}
+	}
+	l.mu.Unlock()
+	time.Sleep(delay)
+	l.mu.Lock()
+	return nil
+}
+
+// release frees the transfer slot of c.
+func (l *Limiter) release(c *clientLimit) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.active--
+	c.active--
+	c.seen = time.Now()
+	close(l.released)
+	l.released = make(chan struct{})
+}
+
+// purge forgets clients without transfers in progress or waiting that have not been seen long enough
+// for their rate limit to have recovered. l.mu must be held.
+func (l *Limiter) purge() {
+	idle := minClientIdle
+	if l.ClientRate > 0 {
+		burst := l.ClientBurst
+		if burst <= 0 {
+			burst = int(math.Ceil(l.ClientRate))
+		}
+		if d := time.Duration(float64(burst) / l.ClientRate * float64(time.Second)); d > idle {
+			idle = d
+		}
+	}
+	if time.Since(l.purged) < idle {
+		return
+	}
+	l.purged = time.Now()
+	for ip, c := range l.clients {
+		if c.active == 0 && c.waiting == 0 && time.Since(c.seen) > idle {
+			delete(l.clients, ip)
+		}
+	}
+}
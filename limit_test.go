@@ -0,0 +1,250 @@
+package ipxe
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"inet.af/netaddr"
+)
+
+func TestLimiter_Acquire(t *testing.T) {
+	a := netaddr.IPv4(192, 168, 2, 10)
+	b := netaddr.IPv4(192, 168, 2, 11)
+	tests := []struct {
+		name    string
+		limiter *Limiter
+		// ips are acquired in order without being released.
+		ips  []netaddr.IP
+		want []bool
+	}{
+		{name: "nil", ips: []netaddr.IP{a, a, a}, want: []bool{true, true, true}},
+		{name: "no limits", limiter: &Limiter{}, ips: []netaddr.IP{a, a, a}, want: []bool{true, true, true}},
+		{name: "max transfers", limiter: &Limiter{MaxTransfers: 2}, ips: []netaddr.IP{a, b, a, b}, want: []bool{true, true, false, false}},
+		{name: "max client transfers", limiter: &Limiter{MaxClientTransfers: 1}, ips: []netaddr.IP{a, b, a, b}, want: []bool{true, true, false, false}},
+		{name: "rate", limiter: &Limiter{Rate: 1, Burst: 2}, ips: []netaddr.IP{a, b, a}, want: []bool{true, true, false}},
+		{name: "client rate", limiter: &Limiter{ClientRate: 1}, ips: []netaddr.IP{a, b, a, b}, want: []bool{true, true, false, false}},
+		{name: "mapped ip", limiter: &Limiter{MaxClientTransfers: 1}, ips: []netaddr.IP{a, netaddr.IPv6Raw(a.As16())}, want: []bool{true, false}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for i, ip := range tt.ips {
+				_, err := tt.limiter.acquire(ip, 0)
+				if (err == nil) != tt.want[i] {
+					t.Fatalf("request %v from %v, got err: %v, want allowed: %v", i, ip, err, tt.want[i])
+				}
+				if err != nil && !errors.Is(err, ErrLimited) {
+					t.Fatalf("error mismatch, got: %v, want: %v", err, ErrLimited)
+				}
+			}
+		})
+	}
+}
+
+func TestLimiter_Release(t *testing.T) {
+	l := &Limiter{MaxTransfers: 1}
+	ip := netaddr.IPv4(192, 168, 2, 10)
+	release, err := l.acquire(ip, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := l.acquire(ip, 0); !errors.Is(err, ErrLimited) {
+		t.Fatalf("error mismatch, got: %v, want: %v", err, ErrLimited)
+	}
+	release()
+	// releasing more than once does not free another slot.
+	release()
+	if _, err := l.acquire(ip, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := l.acquire(ip, 0); !errors.Is(err, ErrLimited) {
+		t.Fatalf("error mismatch, got: %v, want: %v", err, ErrLimited)
+	}
+}
+
+func TestLimiter_Queue(t *testing.T) {
+	l := &Limiter{MaxTransfers: 1}
+	ip := netaddr.IPv4(192, 168, 2, 10)
+	release, err := l.acquire(ip, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.AfterFunc(50*time.Millisecond, release)
+	start := time.Now()
+	if _, err := l.acquire(ip, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("queued for %v, want until the release", d)
+	}
+
+	// the queue times out when nothing is released.
+	start = time.Now()
+	if _, err := l.acquire(ip, 50*time.Millisecond); !errors.Is(err, ErrLimited) {
+		t.Fatalf("error mismatch, got: %v, want: %v", err, ErrLimited)
+	}
+	if d := time.Since(start); d < 50*time.Millisecond {
+		t.Fatalf("queued for %v, want at least 50ms", d)
+	}
+
+	// rate limited requests wait for the rate when it allows them in time.
+	l = &Limiter{Rate: 20, Burst: 1}
+	if _, err := l.acquire(ip, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := l.acquire(ip, time.Second); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLimiter_PurgeWaiting(t *testing.T) {
+	l := &Limiter{MaxTransfers: 1}
+	busy, waiting := netaddr.IPv4(192, 168, 2, 10), netaddr.IPv4(192, 168, 2, 11)
+	release, err := l.acquire(busy, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := l.acquire(waiting, 5*time.Second)
+		errCh <- err
+	}()
+	for i := 0; ; i++ {
+		l.mu.Lock()
+		c, ok := l.clients[waiting]
+		queued := ok && c.waiting == 1
+		l.mu.Unlock()
+		if queued {
+			break
+		}
+		if i == 100 {
+			t.Fatal("request did not wait for the limits")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// a client waiting for longer than it is remembered when idle is kept.
+	l.mu.Lock()
+	c := l.clients[waiting]
+	c.seen = time.Now().Add(-2 * minClientIdle)
+	l.purged = time.Time{}
+	l.purge()
+	_, kept := l.clients[waiting]
+	l.mu.Unlock()
+	if !kept {
+		t.Fatal("expected the waiting client not to be purged")
+	}
+
+	release()
+	if err := <-errCh; err != nil {
+		t.Fatal(err)
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if c.waiting != 0 || c.active != 1 {
+		t.Fatalf("got waiting %v active %v, want waiting 0 active 1", c.waiting, c.active)
+	}
+}
+
+func TestLimiter_QueueTimeout(t *testing.T) {
+	tests := []struct {
+		name string
+		l    *Limiter
+		want time.Duration
+	}{
+		{name: "nil"},
+		{name: "default", l: &Limiter{}, want: defaultQueueTimeout},
+		{name: "set", l: &Limiter{QueueTimeout: time.Second}, want: time.Second},
+		{name: "no waiting", l: &Limiter{QueueTimeout: -1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.l.queueTimeout(); got != tt.want {
+				t.Fatalf("got: %v, want: %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLimiter_OrNew(t *testing.T) {
+	l := &Limiter{MaxTransfers: 2}
+	if got := l.orNew(&Limiter{MaxTransfers: 2}); got != l {
+		t.Fatal("expected the limiter with the same limits to be kept")
+	}
+	n := &Limiter{MaxTransfers: 3}
+	if got := l.orNew(n); got != n {
+		t.Fatal("expected the limiter with new limits")
+	}
+	if got := l.orNew(nil); got != nil {
+		t.Fatal("expected no limiter")
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	l := &Limiter{ClientRate: 0.1}
+	ip := netaddr.IPv4(192, 168, 2, 10)
+	if _, err := l.acquire(ip, 0); err != nil {
+		t.Fatal(err)
+	}
+	_, err := l.acquire(ip, 0)
+	if d := retryAfter(err); d < 9*time.Second || d > 10*time.Second {
+		t.Fatalf("got retry after %v, want about 10s", d)
+	}
+
+	l = &Limiter{MaxTransfers: 1, RetryAfter: 3 * time.Second}
+	if _, err := l.acquire(ip, 0); err != nil {
+		t.Fatal(err)
+	}
+	_, err = l.acquire(ip, 0)
+	if d := retryAfter(err); d != 3*time.Second {
+		t.Fatalf("got retry after %v, want 3s", d)
+	}
+	if d := retryAfter(errors.New("other")); d != defaultRetryAfter {
+		t.Fatalf("got retry after %v, want %v", d, defaultRetryAfter)
+	}
+}
+
+func TestHandlers_Limits(t *testing.T) {
+	files := MapSource{"ipxe.efi": []byte("ipxe")}
+	tftpLimited := testutil.ToFloat64(limitedTotal.WithLabelValues(protocolTFTP))
+	httpLimited := testutil.ToFloat64(limitedTotal.WithLabelValues(protocolHTTP))
+
+	ht := HandleTFTP{Log: logr.Discard(), Files: files, Limits: &Limiter{ClientRate: 0.1}}
+	for i, want := range []error{nil, ErrLimited} {
+		rf := &fakeReaderFrom{addr: net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9999}, content: make([]byte, 4)}
+		if err := ht.ReadHandler("ipxe.efi", rf); !errors.Is(err, want) {
+			t.Fatalf("request %v, error mismatch, got: %v, want: %v", i, err, want)
+		}
+	}
+
+	hh := HandleHTTP{Log: logr.Discard(), Files: files, Limits: &Limiter{ClientRate: 0.1}}
+	for i, want := range []int{http.StatusOK, http.StatusTooManyRequests} {
+		w := httptest.NewRecorder()
+		hh.Handler(w, httptest.NewRequest(http.MethodGet, "/ipxe.efi", nil))
+		if w.Code != want {
+			t.Fatalf("request %v, got status %v, want %v", i, w.Code, want)
+		}
+		if want == http.StatusTooManyRequests && w.Header().Get("Retry-After") != "10" {
+			t.Fatalf("got Retry-After %q, want 10", w.Header().Get("Retry-After"))
+		}
+	}
+
+	hw := HandleTFTP{Log: logr.Discard(), Uploads: &Uploads{Dir: t.TempDir()}, Limits: &Limiter{ClientRate: 0.1}}
+	for i, want := range []error{nil, ErrLimited} {
+		if err := hw.WriteHandler("crash.log", fakeWriterTo{content: []byte("oops")}); !errors.Is(err, want) {
+			t.Fatalf("upload %v, error mismatch, got: %v, want: %v", i, err, want)
+		}
+	}
+
+	if got := testutil.ToFloat64(limitedTotal.WithLabelValues(protocolTFTP)) - tftpLimited; got != 2 {
+		t.Fatalf("tftp limited, got: %v, want: 2", got)
+	}
+	if got := testutil.ToFloat64(limitedTotal.WithLabelValues(protocolHTTP)) - httpLimited; got != 1 {
+		t.Fatalf("http limited, got: %v, want: 1", got)
+	}
+}
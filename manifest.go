@@ -0,0 +1,94 @@
+package ipxe
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/go-logr/logr"
+	"github.com/jacobweinstock/ipxe/binary"
+)
+
+// ManifestPath is the HTTP path the manifest of served files is available at.
+const ManifestPath = "/manifest.json"
+
+// Manifest describes the files being served.
+type Manifest struct {
+	// IPXECommit is the upstream iPXE git commit the embedded iPXE binaries were built from.
+	IPXECommit string `json:"ipxeCommit"`
+	// Files are the files being served.
+	Files []ManifestFile `json:"files"`
+}
+
+// ManifestFile describes a single file being served.
+type ManifestFile struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+	SHA512 string `json:"sha512"`
+	// Arch is the target architecture of the file, when known.
+	Arch string `json:"arch,omitempty"`
+	// Embedded is true when the file is identical to the embedded iPXE binary of the same
+	// name, and so was built from Manifest.IPXECommit.
+	Embedded bool `json:"embedded"`
+}
+
+// HandleManifest serves a JSON Manifest of the files in a FileSource.
+type HandleManifest struct {
+	Log logr.Logger
+	// Files is the source of files to describe. It must implement FileLister.
+	// Defaults to the embedded iPXE binaries.
+	Files FileSource
+}
+
+// Handler handles requests for the manifest.
+func (m HandleManifest) Handler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	man, err := NewManifest(sourceOrDefault(m.Files))
+	if err != nil {
+		m.Log.Error(err, "error building manifest")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(man); err != nil {
+		m.Log.Error(err, "error serving manifest")
+	}
+}
+
+// NewManifest builds a Manifest of all the files in fs, which must implement FileLister.
+// The digests of files are cached by name, size and modification time.
+func NewManifest(fs FileSource) (Manifest, error) {
+	man := Manifest{IPXECommit: binary.IPXECommit, Files: []ManifestFile{}}
+	l, ok := fs.(FileLister)
+	if !ok {
+		return man, errNotLister(fs)
+	}
+	names, err := l.List()
+	if err != nil {
+		return man, err
+	}
+	for _, name := range names {
+		f, err := fs.Open(name)
+		if err != nil {
+			return man, err
+		}
+		d, err := digests.digest(f)
+		f.Close()
+		if err != nil {
+			return man, err
+		}
+		mf := ManifestFile{
+			Name:   name,
+			Size:   f.Size,
+			SHA256: d.sha256,
+			SHA512: d.sha512,
+			Arch:   binary.Archs[name],
+		}
+		mf.Embedded = binary.Checksums[name] == mf.SHA512
+		man.Files = append(man.Files, mf)
+	}
+	return man, nil
+}
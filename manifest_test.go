@@ -0,0 +1,71 @@
+package ipxe
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-logr/logr"
+	"github.com/google/go-cmp/cmp"
+	"github.com/jacobweinstock/ipxe/binary"
+)
+
+func TestHandleManifest_Handler(t *testing.T) {
+	custom := []byte("custom ipxe.efi")
+	src := MapSource{"ipxe.efi": custom, "snp.efi": binary.Files["snp.efi"]}
+	h := HandleManifest{Log: logr.Discard(), Files: src}
+
+	w := httptest.NewRecorder()
+	h.Handler(w, httptest.NewRequest("GET", ManifestPath, nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status mismatch, got: %v, want: %v", w.Code, http.StatusOK)
+	}
+	var got Manifest
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	want := Manifest{
+		IPXECommit: binary.IPXECommit,
+		Files: []ManifestFile{
+			{
+				Name:   "ipxe.efi",
+				Size:   int64(len(custom)),
+				SHA256: sha256Hex(custom),
+				SHA512: sha512Hex(custom),
+				Arch:   "x86_64-efi",
+			},
+			{
+				Name:     "snp.efi",
+				Size:     int64(len(binary.Files["snp.efi"])),
+				SHA256:   sha256Hex(binary.Files["snp.efi"]),
+				SHA512:   binary.Checksums["snp.efi"],
+				Arch:     "arm64-efi",
+				Embedded: true,
+			},
+		},
+	}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Fatal(diff)
+	}
+}
+
+func sha256Hex(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+func TestHandleManifest_HandlerNotLister(t *testing.T) {
+	h := HandleManifest{Log: logr.Discard(), Files: fileSourceFunc(nil)}
+	w := httptest.NewRecorder()
+	h.Handler(w, httptest.NewRequest("GET", ManifestPath, nil))
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("status mismatch, got: %v, want: %v", w.Code, http.StatusInternalServerError)
+	}
+}
+
+type fileSourceFunc func(name string) (*File, error)
+
+func (f fileSourceFunc) Open(name string) (*File, error) { return f(name) }
@@ -0,0 +1,146 @@
+package ipxe
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"inet.af/netaddr"
+)
+
+// MetricsPath is the HTTP path Prometheus metrics are served at.
+const MetricsPath = "/metrics"
+
+// Timeouts of the metrics server, a scrape is a single small request and response.
+const (
+	metricsReadTimeout  = 10 * time.Second
+	metricsWriteTimeout = 30 * time.Second
+	metricsIdleTimeout  = 2 * time.Minute
+)
+
+// Request outcomes, the outcome label of the request metrics.
+const (
+	outcomeOK       = "ok"
+	outcomeNotFound = "not_found"
+	outcomeError    = "error"
+	outcomeDenied   = "denied"
+	outcomeLimited  = "limited"
+)
+
+// Protocols, the protocol label of the request metrics.
+const (
+	protocolTFTP = "tftp"
+	protocolHTTP = "http"
+)
+
+var (
+	requestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "ipxe",
+		Name:      "requests_total",
+		Help:      "Number of file requests by protocol, filename and outcome. Requests that did not open a file have an empty filename.",
+	}, []string{"protocol", "filename", "outcome"})
+	bytesSentTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "ipxe",
+		Name:      "sent_bytes_total",
+		Help:      "Number of file bytes sent by protocol and filename.",
+	}, []string{"protocol", "filename"})
+	transferDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "ipxe",
+		Name:      "transfer_duration_seconds",
+		Help:      "Duration of file transfers by protocol and outcome.",
+		Buckets:   []float64{.01, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60},
+	}, []string{"protocol", "outcome"})
+	notFoundTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "ipxe",
+		Name:      "file_not_found_total",
+		Help:      "Number of requests for unknown files by protocol.",
+	}, []string{"protocol"})
+	deniedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "ipxe",
+		Name:      "access_denied_total",
+		Help:      "Number of requests refused by the ACL by protocol.",
+	}, []string{"protocol"})
+	limitedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "ipxe",
+		Name:      "limited_total",
+		Help:      "Number of requests refused for being over the transfer or rate limits by protocol.",
+	}, []string{"protocol"})
+	tftpActiveTransfers = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "ipxe",
+		Name:      "tftp_active_transfers",
+		Help:      "Number of TFTP transfers in progress.",
+	})
+)
+
+// observeRequest records a finished file request in the Prometheus metrics.
+// filename must be empty for requests that did not open a file, the names requested by
+// clients are not recorded to bound the number of label values.
+func observeRequest(protocol, filename, outcome string, sent int64, d time.Duration) {
+	switch outcome {
+	case outcomeNotFound:
+		notFoundTotal.WithLabelValues(protocol).Inc()
+	case outcomeDenied:
+		deniedTotal.WithLabelValues(protocol).Inc()
+	case outcomeLimited:
+		limitedTotal.WithLabelValues(protocol).Inc()
+	}
+	requestsTotal.WithLabelValues(protocol, filename, outcome).Inc()
+	if sent > 0 {
+		bytesSentTotal.WithLabelValues(protocol, filename).Add(float64(sent))
+	}
+	transferDuration.WithLabelValues(protocol, outcome).Observe(d.Seconds())
+}
+
+// httpOutcome returns the request outcome for an HTTP response status.
+func httpOutcome(status int) string {
+	switch {
+	case status == http.StatusNotFound:
+		return outcomeNotFound
+	case status == http.StatusForbidden:
+		return outcomeDenied
+	case status == http.StatusTooManyRequests:
+		return outcomeLimited
+	case status >= http.StatusBadRequest:
+		return outcomeError
+	default:
+		return outcomeOK
+	}
+}
+
+// ListenAndServeMetrics serves Prometheus metrics at MetricsPath on addr until ctx is canceled.
+func ListenAndServeMetrics(ctx context.Context, addr netaddr.IPPort) error {
+	conn, err := net.Listen("tcp", addr.String())
+	if err != nil {
+		return err
+	}
+	router := http.NewServeMux()
+	router.Handle(MetricsPath, promhttp.Handler())
+	return serveMetrics(ctx, conn, metricsServer(router))
+}
+
+// serveMetrics serves srv on conn until ctx is canceled.
+func serveMetrics(ctx context.Context, conn net.Listener, srv *http.Server) error {
+	go func() {
+		<-ctx.Done()
+		_ = srv.Shutdown(context.Background())
+	}()
+	if err := srv.Serve(conn); err != nil && err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+// metricsServer returns an http.Server for handler with the timeouts of the metrics server.
+func metricsServer(handler http.Handler) *http.Server {
+	return &http.Server{
+		Handler:           handler,
+		ReadTimeout:       metricsReadTimeout,
+		ReadHeaderTimeout: metricsReadTimeout,
+		WriteTimeout:      metricsWriteTimeout,
+		IdleTimeout:       metricsIdleTimeout,
+	}
+}
@@ -0,0 +1,110 @@
+package ipxe
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"inet.af/netaddr"
+)
+
+func TestHTTPOutcome(t *testing.T) {
+	tests := map[int]string{
+		http.StatusOK:                  outcomeOK,
+		http.StatusPartialContent:      outcomeOK,
+		http.StatusNotModified:         outcomeOK,
+		http.StatusNotFound:            outcomeNotFound,
+		http.StatusForbidden:           outcomeDenied,
+		http.StatusTooManyRequests:     outcomeLimited,
+		http.StatusInternalServerError: outcomeError,
+	}
+	for status, want := range tests {
+		if got := httpOutcome(status); got != want {
+			t.Fatalf("status %v, got: %v, want: %v", status, got, want)
+		}
+	}
+}
+
+func TestHandleHTTP_HandlerMetrics(t *testing.T) {
+	h := HandleHTTP{Log: logr.Discard(), Files: MapSource{"metrics.efi": []byte("ipxe")}}
+	served := testutil.ToFloat64(requestsTotal.WithLabelValues(protocolHTTP, "metrics.efi", outcomeOK))
+	sent := testutil.ToFloat64(bytesSentTotal.WithLabelValues(protocolHTTP, "metrics.efi"))
+	unknown := testutil.ToFloat64(notFoundTotal.WithLabelValues(protocolHTTP))
+
+	h.Handler(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/metrics.efi", nil))
+	h.Handler(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/missing.efi", nil))
+
+	if got := testutil.ToFloat64(requestsTotal.WithLabelValues(protocolHTTP, "metrics.efi", outcomeOK)) - served; got != 1 {
+		t.Fatalf("requests, got: %v, want: 1", got)
+	}
+	if got := testutil.ToFloat64(bytesSentTotal.WithLabelValues(protocolHTTP, "metrics.efi")) - sent; got != 4 {
+		t.Fatalf("bytes sent, got: %v, want: 4", got)
+	}
+	if got := testutil.ToFloat64(notFoundTotal.WithLabelValues(protocolHTTP)) - unknown; got != 1 {
+		t.Fatalf("not found, got: %v, want: 1", got)
+	}
+}
+
+func TestHandleHTTP_HandlerMetricsNotOpened(t *testing.T) {
+	tr := &Transfers{}
+	tr.Drain()
+	h := HandleHTTP{Log: logr.Discard(), Files: MapSource{"drained.efi": []byte("ipxe")}, Transfers: tr}
+	unnamed := testutil.ToFloat64(requestsTotal.WithLabelValues(protocolHTTP, "", outcomeError))
+
+	w := httptest.NewRecorder()
+	h.Handler(w, httptest.NewRequest(http.MethodGet, "/drained.efi", nil))
+
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("status, got: %v, want: %v", w.Code, http.StatusServiceUnavailable)
+	}
+	if got := testutil.ToFloat64(requestsTotal.WithLabelValues(protocolHTTP, "", outcomeError)) - unnamed; got != 1 {
+		t.Fatalf("requests without filename, got: %v, want: 1", got)
+	}
+	if requestsTotal.DeleteLabelValues(protocolHTTP, "drained.efi", outcomeError) {
+		t.Fatal("requested filename recorded for a file that was not opened")
+	}
+}
+
+func TestListenAndServeMetrics(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := netaddr.MustParseIPPort(l.Addr().String())
+	l.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errCh := make(chan error, 1)
+	go func() { errCh <- ListenAndServeMetrics(ctx, addr) }()
+
+	var resp *http.Response
+	for i := 0; i < 50; i++ {
+		if resp, err = http.Get("http://" + addr.String() + MetricsPath); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(body), "ipxe_tftp_active_transfers") {
+		t.Fatal("expected ipxe metrics to be served")
+	}
+
+	cancel()
+	if err := <-errCh; err != nil {
+		t.Fatal(err)
+	}
+}
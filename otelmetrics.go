@@ -0,0 +1,152 @@
+package ipxe
+
+import (
+	"context"
+	"time"
+
+	"github.com/jacobweinstock/ipxe/binary"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/metric/global"
+	"go.opentelemetry.io/otel/metric/instrument"
+	"go.opentelemetry.io/otel/metric/instrument/syncfloat64"
+	"go.opentelemetry.io/otel/metric/instrument/syncint64"
+	"go.opentelemetry.io/otel/metric/nonrecording"
+	"go.opentelemetry.io/otel/metric/unit"
+	"inet.af/netaddr"
+)
+
+// instrumentationName is the name of the OpenTelemetry meter the instruments are created with.
+const instrumentationName = "github.com/jacobweinstock/ipxe"
+
+// Client subnet prefix lengths of the client.subnet metric attribute.
+const (
+	subnetBits4 = 24
+	subnetBits6 = 64
+)
+
+// otelMetrics are the OpenTelemetry instruments recorded by HandleTFTP and HandleHTTP.
+type otelMetrics struct {
+	started   syncint64.Counter
+	completed syncint64.Counter
+	failed    syncint64.Counter
+	bytes     syncint64.Counter
+	latency   syncfloat64.Histogram
+}
+
+// otelInstruments are created from the global MeterProvider. Until the embedding application
+// sets one with global.SetMeterProvider nothing is recorded, after that they record through it.
+var otelInstruments = newOTelMetricsOrNoop(global.Meter(instrumentationName))
+
+// newOTelMetrics creates the instruments with m.
+func newOTelMetrics(m metric.Meter) (*otelMetrics, error) {
+	var o otelMetrics
+	var err error
+	if o.started, err = m.SyncInt64().Counter("ipxe.transfers.started", instrument.WithDescription("Number of file transfers started.")); err != nil {
+		return nil, err
+	}
+	if o.completed, err = m.SyncInt64().Counter("ipxe.transfers.completed", instrument.WithDescription("Number of file transfers completed.")); err != nil {
+		return nil, err
+	}
+	if o.failed, err = m.SyncInt64().Counter("ipxe.transfers.failed", instrument.WithDescription("Number of file requests that failed, including requests for unknown files. Requests that did not open a file have an empty filename.")); err != nil {
+		return nil, err
+	}
+	if o.bytes, err = m.SyncInt64().Counter("ipxe.transfers.bytes", instrument.WithDescription("Number of file bytes served."), instrument.WithUnit(unit.Bytes)); err != nil {
+		return nil, err
+	}
+	if o.latency, err = m.SyncFloat64().Histogram("ipxe.transfers.duration", instrument.WithDescription("Duration of file transfers."), instrument.WithUnit(unit.Milliseconds)); err != nil {
+		return nil, err
+	}
+	return &o, nil
+}
+
+// newOTelMetricsOrNoop creates the instruments with m, falling back to instruments that record nothing.
+func newOTelMetricsOrNoop(m metric.Meter) *otelMetrics {
+	o, err := newOTelMetrics(m)
+	if err != nil {
+		o, _ = newOTelMetrics(nonrecording.NewNoopMeter())
+	}
+	return o
+}
+
+// clientSubnet returns the subnet of ip used as a metric attribute, a /24 for IPv4 and a /64 for IPv6.
+func clientSubnet(ip netaddr.IP) string {
+	if ip.IsZero() {
+		return ""
+	}
+	bits := uint8(subnetBits6)
+	if ip.Is4() || ip.Is4in6() {
+		ip = ip.Unmap()
+		bits = subnetBits4
+	}
+	p, err := ip.Prefix(bits)
+	if err != nil {
+		return ""
+	}
+	return p.String()
+}
+
+// fileArch returns the architecture of the named file, as a metric attribute.
+func fileArch(name string) string {
+	if a, ok := binary.Archs[name]; ok {
+		return a
+	}
+	return "unknown"
+}
+
+// request records a single file request in the Prometheus and OpenTelemetry metrics.
+type request struct {
+	ctx      context.Context
+	protocol string
+	filename string
+	client   netaddr.IP
+	arch     string
+	// opened is true once the requested file is opened.
+	opened  bool
+	start   time.Time
+	metrics *otelMetrics
+}
+
+// newRequest starts recording a request for filename, from client, over protocol.
+func newRequest(ctx context.Context, protocol, filename string, client netaddr.IP) *request {
+	return &request{ctx: ctx, protocol: protocol, filename: filename, client: client, arch: fileArch(filename), start: time.Now(), metrics: otelInstruments}
+}
+
+func (r *request) attrs() []attribute.KeyValue {
+	return []attribute.KeyValue{
+		attribute.String("protocol", r.protocol),
+		attribute.String("filename", r.filename),
+		attribute.String("arch", r.arch),
+		attribute.String("client.subnet", clientSubnet(r.client)),
+	}
+}
+
+// started records the start of the transfer of f. f.Name is used for the architecture, as
+// it can differ from the requested file, AutoFile for example.
+func (r *request) started(f *File) {
+	r.arch = fileArch(f.Name)
+	r.opened = true
+	r.metrics.started.Add(r.ctx, 1, r.attrs()...)
+}
+
+// done records the end of the request with the given outcome and number of bytes sent.
+func (r *request) done(outcome string, sent int64) {
+	d := time.Since(r.start)
+	filename := r.filename
+	if !r.opened {
+		filename = ""
+	}
+	observeRequest(r.protocol, filename, outcome, sent, d)
+
+	r.filename = filename
+	attrs := r.attrs()
+	if sent > 0 {
+		r.metrics.bytes.Add(r.ctx, sent, attrs...)
+	}
+	r.metrics.latency.Record(r.ctx, float64(d)/float64(time.Millisecond), attrs...)
+	if outcome == outcomeOK {
+		r.metrics.completed.Add(r.ctx, 1, attrs...)
+		return
+	}
+	r.metrics.failed.Add(r.ctx, 1, append(attrs, attribute.String("outcome", outcome))...)
+}
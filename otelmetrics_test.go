@@ -0,0 +1,171 @@
+package ipxe
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/metric/instrument"
+	"go.opentelemetry.io/otel/metric/instrument/syncfloat64"
+	"go.opentelemetry.io/otel/metric/instrument/syncint64"
+	"go.opentelemetry.io/otel/metric/nonrecording"
+	"inet.af/netaddr"
+)
+
+// fakeMeter is a metric.Meter that records the sum of every synchronous instrument by name.
+type fakeMeter struct {
+	metric.Meter
+	mu    sync.Mutex
+	sums  map[string]float64
+	attrs map[string][]attribute.KeyValue
+}
+
+func newFakeMeter() *fakeMeter {
+	return &fakeMeter{Meter: nonrecording.NewNoopMeter(), sums: map[string]float64{}, attrs: map[string][]attribute.KeyValue{}}
+}
+
+func (m *fakeMeter) record(name string, v float64, attrs []attribute.KeyValue) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sums[name] += v
+	m.attrs[name] = attrs
+}
+
+func (m *fakeMeter) SyncInt64() syncint64.InstrumentProvider { return fakeInt64Provider{m} }
+
+func (m *fakeMeter) SyncFloat64() syncfloat64.InstrumentProvider { return fakeFloat64Provider{m} }
+
+type fakeInt64Provider struct{ m *fakeMeter }
+
+func (p fakeInt64Provider) Counter(name string, _ ...instrument.Option) (syncint64.Counter, error) {
+	c, _ := nonrecording.NewNoopMeter().SyncInt64().Counter(name)
+	return fakeInt64{Counter: c, m: p.m, name: name}, nil
+}
+
+func (p fakeInt64Provider) UpDownCounter(name string, opts ...instrument.Option) (syncint64.UpDownCounter, error) {
+	return p.Counter(name, opts...)
+}
+
+func (p fakeInt64Provider) Histogram(name string, _ ...instrument.Option) (syncint64.Histogram, error) {
+	c, _ := nonrecording.NewNoopMeter().SyncInt64().Counter(name)
+	return fakeInt64{Counter: c, m: p.m, name: name}, nil
+}
+
+type fakeInt64 struct {
+	syncint64.Counter
+	m    *fakeMeter
+	name string
+}
+
+func (f fakeInt64) Add(_ context.Context, v int64, attrs ...attribute.KeyValue) {
+	f.m.record(f.name, float64(v), attrs)
+}
+
+func (f fakeInt64) Record(_ context.Context, v int64, attrs ...attribute.KeyValue) {
+	f.m.record(f.name, float64(v), attrs)
+}
+
+type fakeFloat64Provider struct{ m *fakeMeter }
+
+func (p fakeFloat64Provider) Counter(name string, _ ...instrument.Option) (syncfloat64.Counter, error) {
+	h, _ := nonrecording.NewNoopMeter().SyncFloat64().Counter(name)
+	return fakeFloat64{Counter: h, m: p.m, name: name}, nil
+}
+
+func (p fakeFloat64Provider) UpDownCounter(name string, opts ...instrument.Option) (syncfloat64.UpDownCounter, error) {
+	return p.Counter(name, opts...)
+}
+
+func (p fakeFloat64Provider) Histogram(name string, _ ...instrument.Option) (syncfloat64.Histogram, error) {
+	h, _ := nonrecording.NewNoopMeter().SyncFloat64().Counter(name)
+	return fakeFloat64{Counter: h, m: p.m, name: name}, nil
+}
+
+type fakeFloat64 struct {
+	syncfloat64.Counter
+	m    *fakeMeter
+	name string
+}
+
+func (f fakeFloat64) Add(_ context.Context, v float64, attrs ...attribute.KeyValue) {
+	f.m.record(f.name, v, attrs)
+}
+
+func (f fakeFloat64) Record(_ context.Context, v float64, attrs ...attribute.KeyValue) {
+	f.m.record(f.name, v, attrs)
+}
+
+func TestRequest_OTelMetrics(t *testing.T) {
+	m := newFakeMeter()
+	o, err := newOTelMetrics(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := netaddr.MustParseIP("192.168.2.34")
+
+	r := newRequest(context.Background(), protocolTFTP, AutoFile, client)
+	r.metrics = o
+	r.started(NewFile("snp.efi", []byte("arm64"), startTime))
+	r.done(outcomeOK, 5)
+
+	r = newRequest(context.Background(), protocolHTTP, "missing.efi", client)
+	r.metrics = o
+	r.done(outcomeNotFound, 0)
+
+	// a request refused before the file is opened, e.g. while draining.
+	r = newRequest(context.Background(), protocolHTTP, "unavailable.efi", client)
+	r.metrics = o
+	r.done(outcomeError, 0)
+
+	want := map[string]float64{
+		"ipxe.transfers.started":   1,
+		"ipxe.transfers.completed": 1,
+		"ipxe.transfers.failed":    2,
+		"ipxe.transfers.bytes":     5,
+	}
+	for name, v := range want {
+		if got := m.sums[name]; got != v {
+			t.Fatalf("%v, got: %v, want: %v", name, got, v)
+		}
+	}
+	wantAttrs := []attribute.KeyValue{
+		attribute.String("protocol", protocolTFTP),
+		attribute.String("filename", AutoFile),
+		attribute.String("arch", "arm64-efi"),
+		attribute.String("client.subnet", "192.168.2.0/24"),
+	}
+	if diff := cmp.Diff(m.attrs["ipxe.transfers.completed"], wantAttrs, cmp.Comparer(func(a, b attribute.KeyValue) bool { return a == b })); diff != "" {
+		t.Fatal(diff)
+	}
+	wantAttrs = []attribute.KeyValue{
+		attribute.String("protocol", protocolHTTP),
+		attribute.String("filename", ""),
+		attribute.String("arch", "unknown"),
+		attribute.String("client.subnet", "192.168.2.0/24"),
+		attribute.String("outcome", outcomeError),
+	}
+	if diff := cmp.Diff(m.attrs["ipxe.transfers.failed"], wantAttrs, cmp.Comparer(func(a, b attribute.KeyValue) bool { return a == b })); diff != "" {
+		t.Fatal(diff)
+	}
+}
+
+func TestClientSubnet(t *testing.T) {
+	tests := map[string]string{
+		"192.168.2.34":         "192.168.2.0/24",
+		"::ffff:10.1.2.3":      "10.1.2.0/24",
+		"2001:db8:1:2:3:4:5:6": "2001:db8:1:2::/64",
+		"":                     "",
+	}
+	for in, want := range tests {
+		var ip netaddr.IP
+		if in != "" {
+			ip = netaddr.MustParseIP(in)
+		}
+		if got := clientSubnet(ip); got != want {
+			t.Fatalf("%q, got: %v, want: %v", in, got, want)
+		}
+	}
+}
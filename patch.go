@@ -0,0 +1,209 @@
+package ipxe
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/jacobweinstock/ipxe/binary"
+)
+
+// defaultPatchCacheSize is the default number of patched binaries a PatchSource keeps.
+const defaultPatchCacheSize = 64
+
+// MACFileSource is a FileSource that can tailor the files it returns to the machine requesting them.
+// HandleTFTP and HandleHTTP use OpenFor when their FileSource implements it.
+// The versions of a file for different machines must differ in size or modification time,
+// the digests of served files are cached by name, size and modification time.
+type MACFileSource interface {
+	FileSource
+	// OpenFor returns the named file for the machine with the given MAC address.
+	// mac is nil when the request did not include a MAC address.
+	OpenFor(ctx context.Context, name string, mac net.HardwareAddr) (*File, error)
+}
+
+// PatchSource is a MACFileSource that patches an iPXE script into the embedded script
+// region of the iPXE binaries opened from Source. See binary.Patch for details.
+//
+// The script for a machine comes from Lookup, falling back to Script when Lookup is nil
+// or has no script for the machine. Patched binaries are cached by file and script, and
+// are only re-patched when the file in Source changes. Files without a patchable region
+// (undionly.kpxe, for example, is compressed) are served unmodified and a warning is logged.
+type PatchSource struct {
+	// Source is the FileSource to patch files from.
+	Source FileSource
+	// Script is the default iPXE script to patch into the binaries.
+	Script []byte
+	// Lookup finds the iPXE script for a specific machine.
+	Lookup ScriptLookup
+	// CacheSize is the maximum number of patched binaries to keep in memory. Defaults to 64.
+	CacheSize int
+	// Log is the logger to use.
+	Log logr.Logger
+
+	mu    sync.Mutex
+	cache map[patchKey]*list.Element
+	lru   *list.List
+}
+
+type patchKey struct {
+	name   string
+	script [sha256.Size]byte
+}
+
+type patched struct {
+	key     patchKey
+	size    int64
+	modTime time.Time
+	// content is nil when the file has no patchable region.
+	content []byte
+	// patchedAt is used as the modification time of the patched file. The same file name
+	// and source file are patched with different scripts, so the source file's modification
+	// time can not be used.
+	patchedAt time.Time
+}
+
+// Open implements FileSource. Files are patched with the default Script.
+func (p *PatchSource) Open(name string) (*File, error) {
+	return p.OpenFor(context.Background(), name, nil)
+}
+
+// List implements FileLister when Source does.
+func (p *PatchSource) List() ([]string, error) {
+	l, ok := sourceOrDefault(p.Source).(FileLister)
+	if !ok {
+		return nil, errNotLister(p.Source)
+	}
+	return l.List()
+}
+
+// OpenFor implements MACFileSource.
+func (p *PatchSource) OpenFor(ctx context.Context, name string, mac net.HardwareAddr) (*File, error) {
+	script := p.Script
+	if p.Lookup != nil && len(mac) > 0 {
+		s, err := p.Lookup.Script(ctx, mac)
+		if err != nil {
+			return nil, fmt.Errorf("looking up script for %v: %w", mac, err)
+		}
+		if s != nil {
+			script = s
+		}
+	}
+
+	f, err := sourceOrDefault(p.Source).Open(name)
+	if err != nil || len(script) == 0 {
+		return f, err
+	}
+
+	key := patchKey{name: name, script: sha256.Sum256(script)}
+	if c, ok := p.get(key); ok && c.size == f.Size && c.modTime.Equal(f.ModTime) {
+		if c.content == nil {
+			return f, nil
+		}
+		f.Close()
+		return NewFile(name, c.content, c.patchedAt), nil
+	}
+
+	content, err := io.ReadAll(f)
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+	c := &patched{key: key, size: f.Size, modTime: f.ModTime, patchedAt: time.Now()}
+	c.content, err = binary.Patch(content, script)
+	switch {
+	case errors.Is(err, binary.ErrNoPatchRegion):
+		orDiscard(p.Log).Info("file has no patchable embedded script region, serving it unmodified", "file", name)
+	case err != nil:
+		return nil, fmt.Errorf("patching %q: %w", name, err)
+	}
+	p.put(c)
+
+	if c.content == nil {
+		return NewFile(name, content, f.ModTime), nil
+	}
+	return NewFile(name, c.content, c.patchedAt), nil
+}
+
+func (p *PatchSource) get(key patchKey) (*patched, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	e, ok := p.cache[key]
+	if !ok {
+		return nil, false
+	}
+	p.lru.MoveToFront(e)
+	return e.Value.(*patched), true
+}
+
+func (p *PatchSource) put(c *patched) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.cache == nil {
+		p.cache = make(map[patchKey]*list.Element)
+		p.lru = list.New()
+	}
+	if e, ok := p.cache[c.key]; ok {
+		e.Value = c
+		p.lru.MoveToFront(e)
+		return
+	}
+	p.cache[c.key] = p.lru.PushFront(c)
+
+	size := p.CacheSize
+	if size <= 0 {
+		size = defaultPatchCacheSize
+	}
+	for p.lru.Len() > size {
+		oldest := p.lru.Back()
+		p.lru.Remove(oldest)
+		delete(p.cache, oldest.Value.(*patched).key)
+	}
+}
+
+// checkPatchable returns an error when none of the iPXE binaries in fs has a patchable
+// embedded script region, as a script patched into them would never be served.
+// The binaries without one are logged.
+func checkPatchable(fs FileSource, log logr.Logger) error {
+	var unpatchable []string
+	found := false
+	for _, name := range sortedNames(binary.Files) {
+		f, err := fs.Open(name)
+		if err != nil {
+			continue
+		}
+		content, err := io.ReadAll(f)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("reading %q: %w", name, err)
+		}
+		if binary.HasPatchRegion(content) {
+			found = true
+		} else {
+			unpatchable = append(unpatchable, name)
+		}
+	}
+	if !found {
+		return fmt.Errorf("none of the served iPXE binaries %v has a patchable embedded script region, they must be built from binary/script/embed-patchable.ipxe (make binary/patchable): %w", unpatchable, binary.ErrNoPatchRegion)
+	}
+	for _, name := range unpatchable {
+		orDiscard(log).Info("file has no patchable embedded script region, it is served unmodified", "file", name)
+	}
+	return nil
+}
+
+// openFor opens name from fs, tailored to mac when fs is a MACFileSource.
+func openFor(ctx context.Context, fs FileSource, name string, mac net.HardwareAddr) (*File, error) {
+	fs = sourceOrDefault(fs)
+	if m, ok := fs.(MACFileSource); ok {
+		return m.OpenFor(ctx, name, mac)
+	}
+	return fs.Open(name)
+}
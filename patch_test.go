@@ -0,0 +1,219 @@
+package ipxe
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-logr/logr"
+	"github.com/google/go-cmp/cmp"
+	"github.com/jacobweinstock/ipxe/binary"
+	"inet.af/netaddr"
+)
+
+func TestPatchSource_Open(t *testing.T) {
+	region := "#ipxe-patch-begin\nautoboot\n" + strings.Repeat("#", 32) + "\n#ipxe-patch-end\n"
+	src := MapSource{
+		"ipxe.efi":      []byte("#!ipxe\n" + region),
+		"undionly.kpxe": []byte("compressed"),
+	}
+	p := &PatchSource{Source: src, Script: []byte("#!ipxe\nexit\n"), Log: logr.Discard()}
+	tests := []struct {
+		name string
+		file string
+		want string
+	}{
+		{name: "patched", file: "ipxe.efi", want: "#!ipxe\n\nexit\n" + strings.Repeat("\n", len(region)-len("\nexit\n"))},
+		{name: "patched from cache", file: "ipxe.efi", want: "#!ipxe\n\nexit\n" + strings.Repeat("\n", len(region)-len("\nexit\n"))},
+		{name: "no patch region", file: "undionly.kpxe", want: "compressed"},
+		{name: "no patch region from cache", file: "undionly.kpxe", want: "compressed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := p.Open(tt.file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := ioutil.ReadAll(f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(string(got), tt.want); diff != "" {
+				t.Fatal(diff)
+			}
+		})
+	}
+	if p.lru.Len() != 2 {
+		t.Fatalf("expected 2 cached files, got: %v", len(p.cache))
+	}
+}
+
+func TestPatchSource_OpenFor(t *testing.T) {
+	region := "#ipxe-patch-begin\nautoboot\n" + strings.Repeat("#", 32) + "\n#ipxe-patch-end\n"
+	src := MapSource{"ipxe.efi": []byte("#!ipxe\n" + region)}
+	known, _ := net.ParseMAC("aa:bb:cc:dd:ee:ff")
+	unknown, _ := net.ParseMAC("00:00:00:00:00:01")
+	p := &PatchSource{
+		Source:    src,
+		Script:    []byte("default\n"),
+		Lookup:    ScriptMap{known.String(): []byte("machine\n")},
+		CacheSize: 1,
+	}
+	pad := func(s string) string { return "#!ipxe\n" + s + strings.Repeat("\n", len(region)-len(s)) }
+	tests := []struct {
+		name string
+		mac  net.HardwareAddr
+		want string
+	}{
+		{name: "per machine script", mac: known, want: pad("machine\n")},
+		{name: "unknown machine", mac: unknown, want: pad("default\n")},
+		{name: "no mac", want: pad("default\n")},
+		{name: "per machine script after eviction", mac: known, want: pad("machine\n")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := p.OpenFor(context.Background(), "ipxe.efi", tt.mac)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := ioutil.ReadAll(f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(string(got), tt.want); diff != "" {
+				t.Fatal(diff)
+			}
+			if p.lru.Len() != 1 {
+				t.Fatalf("expected 1 cached file, got: %v", p.lru.Len())
+			}
+		})
+	}
+
+	p.Lookup = ScriptLookupFunc(func(context.Context, net.HardwareAddr) ([]byte, error) {
+		return nil, errors.New("inventory unavailable")
+	})
+	if _, err := p.OpenFor(context.Background(), "ipxe.efi", known); err == nil {
+		t.Fatal("expected lookup error")
+	}
+}
+
+func TestServer_PatchedScript(t *testing.T) {
+	// the fixture stands in for a binary built by make binary/patchable,
+	// it embeds the same script between the bytes of an embedded binary.
+	embed, err := ioutil.ReadFile("binary/script/embed-patchable.ipxe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fixture := append(append(append([]byte{}, binary.Files["ipxe.efi"]...), embed...), binary.Files["ipxe.efi"]...)
+	mac, _ := net.ParseMAC("aa:bb:cc:dd:ee:ff")
+	machine := "#!ipxe\nchain http://192.168.2.1/aa-bb-cc-dd-ee-ff.ipxe\n"
+	loopback := netaddr.IPPortFrom(netaddr.IPv4(127, 0, 0, 1), 0)
+	s, err := NewServer(Config{
+		TFTP:           TFTP{Addr: loopback},
+		HTTP:           HTTP{Addr: loopback},
+		Files:          MapSource{"ipxe.efi": fixture, "undionly.kpxe": binary.Files["undionly.kpxe"]},
+		EmbeddedScript: []byte("#!ipxe\nchain http://192.168.2.1/default.ipxe\n"),
+		Scripts:        ScriptMap{mac.String(): []byte(machine)},
+		Log:            logr.Discard(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Shutdown(context.Background())
+
+	httpGet := func(name string) ([]byte, error) {
+		resp, err := http.Get("http://" + s.HTTPAddr().String() + "/" + name)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		return ioutil.ReadAll(resp.Body)
+	}
+	tftp := func(name string) ([]byte, error) {
+		got, _, err := tftpGet(s.TFTPAddr().String(), name, nil, 0)
+		return got, err
+	}
+	tests := []struct {
+		name string
+		file string
+		want string
+	}{
+		{name: "per machine script", file: "aa:bb:cc:dd:ee:ff/ipxe.efi", want: "\nchain http://192.168.2.1/aa-bb-cc-dd-ee-ff.ipxe\n"},
+		{name: "embedded script", file: "ipxe.efi", want: "\nchain http://192.168.2.1/default.ipxe\n"},
+	}
+	for _, tt := range tests {
+		for proto, get := range map[string]func(string) ([]byte, error){"tftp": tftp, "http": httpGet} {
+			t.Run(tt.name+" over "+proto, func(t *testing.T) {
+				got, err := get(tt.file)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !strings.Contains(string(got), "#!ipxe\n"+tt.want) {
+					t.Fatal("served binary does not contain the patched script")
+				}
+				if strings.Contains(string(got), "#ipxe-patch-begin") {
+					t.Fatal("served binary still contains the embedded script")
+				}
+				if len(got) != len(fixture) {
+					t.Fatalf("patched binary size changed, got: %v, want: %v", len(got), len(fixture))
+				}
+			})
+		}
+	}
+	got, err := tftp("aa:bb:cc:dd:ee:ff/undionly.kpxe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(got, binary.Files["undionly.kpxe"]); diff != "" {
+		t.Fatal("expected undionly.kpxe to be served unmodified")
+	}
+}
+
+func TestHandleHTTP_HandlerMACScript(t *testing.T) {
+	region := "#ipxe-patch-begin\n" + strings.Repeat("#", 32) + "\n#ipxe-patch-end\n"
+	h := HandleHTTP{
+		Log: logr.Discard(),
+		Files: &PatchSource{
+			Source: MapSource{"ipxe.efi": []byte(region)},
+			Lookup: ScriptMap{"aa:bb:cc:dd:ee:ff": []byte("machine\n")},
+		},
+	}
+	w := httptest.NewRecorder()
+	h.Handler(w, httptest.NewRequest("GET", "/aa:bb:cc:dd:ee:ff/ipxe.efi", nil))
+	want := "machine\n" + strings.Repeat("\n", len(region)-len("machine\n"))
+	if diff := cmp.Diff(w.Body.String(), want); diff != "" {
+		t.Fatal(diff)
+	}
+}
+
+func TestNewServer_Patchable(t *testing.T) {
+	region := "#ipxe-patch-begin\nautoboot\n" + strings.Repeat("#", 32) + "\n#ipxe-patch-end\n"
+	tests := []struct {
+		name    string
+		files   MapSource
+		wantErr error
+	}{
+		{name: "patchable", files: MapSource{"ipxe.efi": []byte("#!ipxe\n" + region), "undionly.kpxe": []byte("compressed")}},
+		{name: "no patchable binary", files: MapSource{"ipxe.efi": []byte("#!ipxe\nautoboot\n"), "undionly.kpxe": []byte("compressed")}, wantErr: binary.ErrNoPatchRegion},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, c := range []Config{
+				{Files: tt.files, EmbeddedScript: []byte("#!ipxe\nexit\n"), Log: logr.Discard()},
+				{Files: tt.files, Scripts: ScriptMap{}, Log: logr.Discard()},
+			} {
+				if _, err := NewServer(c); !errors.Is(err, tt.wantErr) {
+					t.Fatalf("error mismatch, got: %v, want: %v", err, tt.wantErr)
+				}
+			}
+		})
+	}
+}
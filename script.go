@@ -0,0 +1,57 @@
+package ipxe
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+)
+
+// ScriptLookup finds the iPXE script to embed in the binaries served to a specific machine.
+type ScriptLookup interface {
+	// Script returns the iPXE script for the machine with the given MAC address.
+	// A nil script and a nil error mean the machine has no script of its own.
+	Script(ctx context.Context, mac net.HardwareAddr) ([]byte, error)
+}
+
+// ScriptLookupFunc is an adapter to allow the use of ordinary functions as a ScriptLookup.
+type ScriptLookupFunc func(ctx context.Context, mac net.HardwareAddr) ([]byte, error)
+
+// Script implements ScriptLookup.
+func (f ScriptLookupFunc) Script(ctx context.Context, mac net.HardwareAddr) ([]byte, error) {
+	return f(ctx, mac)
+}
+
+// ScriptMap is a ScriptLookup backed by a map of MAC addresses to iPXE scripts.
+// Keys are MAC addresses in the format returned by net.HardwareAddr.String.
+type ScriptMap map[string][]byte
+
+// Script implements ScriptLookup.
+func (s ScriptMap) Script(_ context.Context, mac net.HardwareAddr) ([]byte, error) {
+	return s[mac.String()], nil
+}
+
+// LoadScriptMap reads a ScriptMap from a JSON file containing an object
+// of MAC addresses to iPXE scripts. For example:
+//
+//	{"aa:bb:cc:dd:ee:ff": "#!ipxe\nchain http://192.168.2.1/auto.ipxe\n"}
+func LoadScriptMap(file string) (ScriptMap, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	raw := map[string]string{}
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return nil, fmt.Errorf("parsing %q: %w", file, err)
+	}
+	m := make(ScriptMap, len(raw))
+	for k, v := range raw {
+		mac, err := net.ParseMAC(k)
+		if err != nil {
+			return nil, fmt.Errorf("parsing %q: %w", file, err)
+		}
+		m[mac.String()] = []byte(v)
+	}
+	return m, nil
+}
@@ -0,0 +1,37 @@
+package ipxe
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestLoadScriptMap(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "scripts.json")
+	if err := ioutil.WriteFile(file, []byte(`{"AA-BB-CC-DD-EE-FF": "#!ipxe\nexit\n"}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	m, err := LoadScriptMap(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mac, _ := net.ParseMAC("aa:bb:cc:dd:ee:ff")
+	got, err := m.Script(context.Background(), mac)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(string(got), "#!ipxe\nexit\n"); diff != "" {
+		t.Fatal(diff)
+	}
+
+	if err := ioutil.WriteFile(file, []byte(`{"not a mac": "exit"}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadScriptMap(file); err == nil {
+		t.Fatal("expected error for invalid MAC address")
+	}
+}
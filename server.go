@@ -0,0 +1,588 @@
+package ipxe
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/imdario/mergo"
+	"github.com/jacobweinstock/ipxe/binary"
+	"github.com/pin/tftp"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"golang.org/x/net/netutil"
+	"golang.org/x/sync/errgroup"
+	"inet.af/netaddr"
+)
+
+// Server serves iPXE binaries over TFTP and HTTP, and the optional proxyDHCP and metrics
+// servers, as configured by a Config. Unlike Config.Serve it does not block, and reports
+// the addresses it is bound to, so a Config can listen on port 0.
+type Server struct {
+	archs     *ArchCache
+	hl        *health
+	hook      *TFTPHook
+	transfers *Transfers
+
+	// hmu guards c and the handlers, which Reload replaces.
+	hmu      sync.RWMutex
+	c        Config
+	tftp     HandleTFTP
+	http     HandleHTTP
+	manifest HandleManifest
+
+	mu      sync.Mutex
+	started bool
+	tconn   *net.UDPConn
+	hconn   net.Listener
+	mconn   net.Listener
+	dconns  []*net.UDPConn
+	st      *tftp.Server
+	ws      *windowServer
+	// tserved is closed when the TFTP server returns.
+	tserved chan struct{}
+	srv     *http.Server
+	tftpErr error
+	httpErr error
+	cancel  context.CancelFunc
+	stop    sync.Once
+	err     error
+	done    chan struct{}
+}
+
+// NewServer returns a Server for c, with the defaults of Config.Serve applied.
+// The served files are verified, nothing is bound until Start.
+func NewServer(c Config) (*Server, error) {
+	archs := &ArchCache{}
+	c, err := c.prepare(archs)
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{archs: archs, hl: &health{}, hook: &TFTPHook{}, transfers: &Transfers{}, done: make(chan struct{})}
+	s.setConfig(c)
+	return s, nil
+}
+
+// setConfig makes c the configuration of the Server and builds the handlers for it.
+func (s *Server) setConfig(c Config) {
+	s.hmu.Lock()
+	defer s.hmu.Unlock()
+	s.c = c
+	s.tftp = HandleTFTP{Log: c.Log, Files: c.Files, Hook: s.hook, Uploads: c.TFTP.Uploads, ACL: c.ACL, Limits: c.TFTP.Limits, Transfers: s.transfers}
+	s.http = HandleHTTP{Log: c.Log, Files: c.Files, ACL: c.ACL, Limits: c.HTTP.Limits, Transfers: s.transfers}
+	s.manifest = HandleManifest{Log: c.Log, Files: c.Files}
+}
+
+// config returns the configuration of the Server.
+func (s *Server) config() Config {
+	s.hmu.RLock()
+	defer s.hmu.RUnlock()
+	return s.c
+}
+
+// Reload replaces the configuration of a Server, without closing its listeners or
+// interrupting the transfers in progress, which finish with the previous configuration.
+// The files are verified and c is validated first, on error the previous configuration is
+// kept. Only the served files, scripts, AutoSelect, ACL, limits, uploads and drain timeout
+// are reloaded. The listen addresses and the settings of the servers need a restart, the
+// ones that changed are logged.
+func (s *Server) Reload(c Config) error {
+	c, err := c.prepare(s.archs)
+	if err != nil {
+		return err
+	}
+	old := s.config()
+	for _, name := range restartSettings(old, c) {
+		c.Log.Info("setting changed, it is only applied by a restart", "setting", name)
+	}
+	uploads := c.TFTP.Uploads
+	// unchanged limits keep their state, the transfers in progress count against them.
+	tftpLimits, httpLimits := old.TFTP.Limits.orNew(c.TFTP.Limits), old.HTTP.Limits.orNew(c.HTTP.Limits)
+	// the servers keep running with the settings they were started with.
+	c.TFTP, c.HTTP, c.ProxyDHCP, c.Metrics = old.TFTP, old.HTTP, old.ProxyDHCP, old.Metrics
+	c.TFTP.Uploads, c.TFTP.Limits, c.HTTP.Limits = uploads, tftpLimits, httpLimits
+	s.setConfig(c)
+	return nil
+}
+
+// reloadedSettings are the settings of the servers that Reload applies.
+var reloadedSettings = map[string]bool{"TFTP.Uploads": true, "TFTP.Limits": true, "HTTP.Limits": true}
+
+// restartSettings returns the names of the settings of the servers that differ between old
+// and c and are not applied by Reload. Funcs, like TFTP.Backoff, cannot be compared and are skipped.
+func restartSettings(old, c Config) []string {
+	servers := []struct {
+		name     string
+		old, new interface{}
+	}{
+		{name: "TFTP", old: old.TFTP, new: c.TFTP},
+		{name: "HTTP", old: old.HTTP, new: c.HTTP},
+		{name: "ProxyDHCP", old: old.ProxyDHCP, new: c.ProxyDHCP},
+		{name: "Metrics", old: old.Metrics, new: c.Metrics},
+	}
+	var changed []string
+	for _, s := range servers {
+		o, n := reflect.ValueOf(s.old), reflect.ValueOf(s.new)
+		for i := 0; i < o.NumField(); i++ {
+			name := s.name + "." + o.Type().Field(i).Name
+			if reloadedSettings[name] || o.Field(i).Kind() == reflect.Func {
+				continue
+			}
+			if !reflect.DeepEqual(o.Field(i).Interface(), n.Field(i).Interface()) {
+				changed = append(changed, name)
+			}
+		}
+	}
+	return changed
+}
+
+// readTFTP, writeTFTP, serveHTTP and serveManifest call the handlers of the current configuration.
+
+func (s *Server) readTFTP(filename string, rf io.ReaderFrom) error {
+	s.hmu.RLock()
+	h := s.tftp
+	s.hmu.RUnlock()
+	return h.ReadHandler(filename, rf)
+}
+
+func (s *Server) writeTFTP(filename string, wt io.WriterTo) error {
+	s.hmu.RLock()
+	h := s.tftp
+	s.hmu.RUnlock()
+	return h.WriteHandler(filename, wt)
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, req *http.Request) {
+	s.hmu.RLock()
+	h := s.http
+	s.hmu.RUnlock()
+	h.Handler(w, req)
+}
+
+func (s *Server) serveManifest(w http.ResponseWriter, req *http.Request) {
+	s.hmu.RLock()
+	h := s.manifest
+	s.hmu.RUnlock()
+	h.Handler(w, req)
+}
+
+// prepare returns c with the defaults of Config.Serve applied and its files verified and
+// wrapped for serving, recording the architecture of clients in archs.
+func (c Config) prepare(archs *ArchCache) (Config, error) {
+	defaults := Config{
+		TFTP: TFTP{Addr: netaddr.IPPortFrom(netaddr.IPv4(0, 0, 0, 0), 69), Timeout: 5 * time.Second},
+		HTTP: HTTP{
+			Addr:         netaddr.IPPortFrom(netaddr.IPv4(0, 0, 0, 0), 8080),
+			Timeout:      5 * time.Second,
+			WriteTimeout: time.Minute,
+			IdleTimeout:  2 * time.Minute,
+		},
+		DrainTimeout: 30 * time.Second,
+		Log:          logr.Discard(),
+	}
+	err := mergo.Merge(&c, defaults, mergo.WithTransformers(ipport{}), mergo.WithTransformers(logger{}))
+	if err != nil {
+		return Config{}, err
+	}
+	if c.TFTP.Disabled && c.HTTP.Disabled {
+		return Config{}, errors.New("tftp and http are both disabled")
+	}
+	if c.HTTP.ReadTimeout == 0 {
+		c.HTTP.ReadTimeout = c.HTTP.Timeout
+	}
+	if c.HTTP.ReadHeaderTimeout == 0 {
+		c.HTTP.ReadHeaderTimeout = c.HTTP.Timeout
+	}
+
+	if err := verifyFiles(EmbeddedSource(), sortedNames(binary.Files), Checksums(binary.Checksums), c.Verify, c.Log); err != nil {
+		return Config{}, fmt.Errorf("verifying embedded iPXE binaries: %w", err)
+	}
+	if c.Files == nil {
+		c.Files = EmbeddedSource()
+	} else if l, ok := c.Files.(FileLister); ok {
+		names, err := l.List()
+		if err != nil {
+			return Config{}, err
+		}
+		if err := verifyFiles(c.Files, names, c.Checksums, c.Verify, c.Log); err != nil {
+			return Config{}, fmt.Errorf("verifying files: %w", err)
+		}
+	}
+	if len(c.EmbeddedScript) > 0 || c.Scripts != nil {
+		if err := checkPatchable(c.Files, c.Log); err != nil {
+			return Config{}, err
+		}
+		c.Files = &PatchSource{Source: c.Files, Script: c.EmbeddedScript, Lookup: c.Scripts, Log: c.Log}
+	}
+	c.Files = &AutoSource{Source: c.Files, Archs: archs, Overrides: c.Auto.Overrides, Default: c.Auto.Default, Log: c.Log}
+
+	if u := c.TFTP.Uploads; u != nil {
+		if fi, err := os.Stat(u.Dir); err != nil || !fi.IsDir() {
+			return Config{}, fmt.Errorf("tftp upload dir %q is not a directory", u.Dir)
+		}
+	}
+	if c.ProxyDHCP.Enabled {
+		if _, err := c.proxyDHCPHandler(archs); err != nil {
+			return Config{}, err
+		}
+	}
+
+	return c, nil
+}
+
+// Start binds the listeners and serves in the background until ctx is canceled, Shutdown
+// is called or a server fails. A Server can only be started once.
+func (s *Server) Start(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.started {
+		return errors.New("server already started")
+	}
+	c := s.config()
+
+	// Bind the listeners before serving, readiness is only reported once they are bound.
+	if err := s.listen(&c); err != nil {
+		s.closeListeners()
+		return err
+	}
+
+	var dhcp *HandleProxyDHCP
+	if c.ProxyDHCP.Enabled {
+		// built after binding, clients are pointed at the bound ports.
+		var err error
+		if dhcp, err = c.proxyDHCPHandler(s.archs); err != nil {
+			s.closeListeners()
+			return err
+		}
+	}
+
+	s.started = true
+	ctx, s.cancel = context.WithCancel(ctx)
+	g, ctx := errgroup.WithContext(ctx)
+
+	if s.tconn != nil {
+		s.st = tftp.NewServer(s.readTFTP, s.writeTFTP)
+		s.st.SetHook(s.hook)
+		c.TFTP.configure(s.st)
+		var tc net.PacketConn = s.tconn
+		if c.TFTP.windowed() {
+			s.ws = newWindowServer(s.tconn, s.readTFTP, s.hook, c.TFTP, c.Log)
+			tc = s.ws
+		} else if c.TFTP.WindowSize > 1 {
+			c.Log.Info("TFTP window size is not supported in single port mode, transfers are lock-step")
+		}
+		st := s.st
+		s.tserved = make(chan struct{})
+		served := s.tserved
+		g.Go(func() error {
+			defer close(served)
+			c.Log.Info("serving TFTP", "addr", c.TFTP.Addr, "timeout", c.TFTP.Timeout, "max retries", c.TFTP.MaxRetries,
+				"block size", c.TFTP.BlockSize, "window size", c.TFTP.WindowSize, "single port", c.TFTP.SinglePort)
+			if err := ServeTFTP(ctx, tc, st); err != nil {
+				err = fmt.Errorf("tftp serve error: %w", err)
+				s.mu.Lock()
+				s.tftpErr = err
+				s.mu.Unlock()
+				return err
+			}
+			return nil
+		})
+	} else {
+		c.Log.Info("TFTP is disabled")
+	}
+
+	if s.hconn != nil {
+		router := http.NewServeMux()
+		router.HandleFunc("/", s.serveHTTP)
+		router.HandleFunc(ManifestPath, s.serveManifest)
+		router.HandleFunc(HealthzPath, s.hl.healthz)
+		router.HandleFunc(ReadyzPath, s.hl.readyz)
+
+		s.srv = c.HTTP.server(router)
+		hconn, srv := s.hconn, s.srv
+		g.Go(func() error {
+			c.Log.Info("serving HTTP", "addr", c.HTTP.Addr, "read timeout", c.HTTP.ReadTimeout, "read header timeout", c.HTTP.ReadHeaderTimeout,
+				"write timeout", c.HTTP.WriteTimeout, "idle timeout", c.HTTP.IdleTimeout, "max conns", c.HTTP.MaxConns, "max header bytes", c.HTTP.MaxHeaderBytes)
+			if err := ServeHTTP(ctx, hconn, srv); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				err = fmt.Errorf("http serve error: %w", err)
+				s.mu.Lock()
+				s.httpErr = err
+				s.mu.Unlock()
+				return err
+			}
+			return nil
+		})
+	} else {
+		c.Log.Info("HTTP is disabled")
+	}
+
+	if s.mconn != nil {
+		router := http.NewServeMux()
+		router.Handle(MetricsPath, promhttp.Handler())
+		// a host serving only TFTP has no other health endpoints.
+		router.HandleFunc(HealthzPath, s.hl.healthz)
+		router.HandleFunc(ReadyzPath, s.hl.readyz)
+		mconn := s.mconn
+		g.Go(func() error {
+			c.Log.Info("serving metrics", "addr", c.Metrics.Addr, "path", MetricsPath)
+			if err := serveMetrics(ctx, mconn, metricsServer(router)); err != nil {
+				return fmt.Errorf("metrics serve error: %w", err)
+			}
+			return nil
+		})
+	}
+
+	if dhcp != nil {
+		if dhcp.HTTPAddr.IsZero() {
+			c.Log.Info("HTTP is disabled, proxyDHCP does not answer UEFI HTTP Boot clients")
+		}
+		for _, conn := range s.dconns {
+			conn := conn
+			g.Go(func() error {
+				c.Log.Info("serving proxyDHCP", "addr", addrPort(conn.LocalAddr()), "public-ip", dhcp.TFTPAddr.IP())
+				if err := ServeProxyDHCP(ctx, conn, dhcp); err != nil {
+					return fmt.Errorf("proxyDHCP serve error: %w", err)
+				}
+				return nil
+			})
+		}
+	}
+
+	s.hl.setReady(true)
+
+	go func() {
+		// errgroup.WithContext: The derived Context is canceled the first time a function
+		// passed to Go returns a non-nil error or the first time Wait returns, whichever occurs first.
+		<-ctx.Done()
+		s.stop.Do(func() { _ = s.shutdown(context.Background()) })
+		s.err = g.Wait()
+		close(s.done)
+	}()
+	return nil
+}
+
+// Shutdown stops the servers gracefully. The listeners stop accepting new transfers, and the
+// transfers in progress have until Config.DrainTimeout or ctx is done to finish, whichever
+// is first, before they are aborted. It returns the error of the drain when transfers were
+// aborted, and ctx.Err() when the servers have not stopped by the time ctx is done.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	started := s.started
+	s.mu.Unlock()
+	if !started {
+		return nil
+	}
+	var err error
+	s.stop.Do(func() { err = s.shutdown(ctx) })
+	s.cancel()
+	if err != nil {
+		return err
+	}
+	select {
+	case <-s.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// shutdown stops the TFTP and HTTP servers. Transfers in progress have until the drain
+// timeout or ctx is done to finish, then they are aborted and the error of the drain is returned.
+func (s *Server) shutdown(ctx context.Context) error {
+	s.hl.setReady(false)
+	s.mu.Lock()
+	tftpErr, httpErr := s.tftpErr, s.httpErr
+	s.mu.Unlock()
+
+	c := s.config()
+	drain, cancel := context.WithTimeout(ctx, c.DrainTimeout)
+	defer cancel()
+	s.transfers.Drain()
+	c.Log.Info("shutting down", "drain timeout", c.DrainTimeout, "transfers in progress", s.transfers.Active())
+
+	var wg sync.WaitGroup
+	// Don't shutdown if the TFTP server failed, this will cause an immediate program exit without a stacktrace.
+	if s.st != nil && tftpErr == nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// pin/tftp does not close the connection in single port mode, shutdownTFTP does. Transfers in
+			// progress use the connection too, so they are drained first.
+			if c.TFTP.SinglePort {
+				_ = s.transfers.Wait(drain)
+			}
+			var conn io.Closer = s.tconn
+			if s.ws != nil {
+				conn = s.ws
+			}
+			shutdownTFTP(s.st, conn, s.hook, s.tserved)
+			if s.ws != nil {
+				s.ws.wait()
+			}
+		}()
+	}
+	// Don't shutdown if the HTTP server failed, this will cause an immediate program exit without a stacktrace.
+	if s.srv != nil && httpErr == nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := s.srv.Shutdown(drain); err != nil {
+				_ = s.srv.Close()
+			}
+		}()
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		return nil
+	case <-drain.Done():
+	}
+	n := s.transfers.Abort()
+	c.Log.Info("aborted transfers still in progress after the drain timeout", "count", n)
+	err := drain.Err()
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+	}
+	return err
+}
+
+// listen binds the listeners of the enabled servers, and sets the addresses in c to the bound ones.
+func (s *Server) listen(c *Config) error {
+	if !c.TFTP.Disabled {
+		taddr, err := net.ResolveUDPAddr("udp", c.TFTP.Addr.String())
+		if err != nil {
+			return err
+		}
+		if s.tconn, err = net.ListenUDP("udp", taddr); err != nil {
+			return fmt.Errorf("tftp listen error: %w", err)
+		}
+		c.TFTP.Addr = addrPort(s.tconn.LocalAddr())
+	}
+	if !c.HTTP.Disabled {
+		hconn, err := net.Listen("tcp", c.HTTP.Addr.String())
+		if err != nil {
+			return fmt.Errorf("http listen error: %w", err)
+		}
+		c.HTTP.Addr = addrPort(hconn.Addr())
+		if c.HTTP.MaxConns > 0 {
+			hconn = netutil.LimitListener(hconn, c.HTTP.MaxConns)
+		}
+		s.hconn = hconn
+	}
+	if !c.Metrics.Addr.IsZero() {
+		mconn, err := net.Listen("tcp", c.Metrics.Addr.String())
+		if err != nil {
+			return fmt.Errorf("metrics listen error: %w", err)
+		}
+		c.Metrics.Addr = addrPort(mconn.Addr())
+		s.mconn = mconn
+	}
+	if c.ProxyDHCP.Enabled {
+		ip := c.ProxyDHCP.Addr
+		if ip.IsZero() {
+			ip = netaddr.IPv4(0, 0, 0, 0)
+		}
+		for _, port := range []uint16{ProxyDHCPPort, PXEPort} {
+			conn, err := net.ListenUDP("udp4", netaddr.IPPortFrom(ip, port).UDPAddr())
+			if err != nil {
+				return fmt.Errorf("proxyDHCP listen error: %w", err)
+			}
+			s.dconns = append(s.dconns, conn)
+		}
+	}
+	return nil
+}
+
+// closeListeners closes the bound listeners of a Server that failed to start.
+func (s *Server) closeListeners() {
+	if s.tconn != nil {
+		s.tconn.Close()
+		s.tconn = nil
+	}
+	if s.hconn != nil {
+		s.hconn.Close()
+		s.hconn = nil
+	}
+	if s.mconn != nil {
+		s.mconn.Close()
+		s.mconn = nil
+	}
+	for _, conn := range s.dconns {
+		conn.Close()
+	}
+	s.dconns = nil
+}
+
+// Done returns a channel that is closed once the Server has stopped serving.
+func (s *Server) Done() <-chan struct{} {
+	return s.done
+}
+
+// Err returns the error the Server stopped with, nil when it was shut down or its context
+// was canceled. It is only set once Done is closed.
+func (s *Server) Err() error {
+	select {
+	case <-s.done:
+		return s.err
+	default:
+		return nil
+	}
+}
+
+// TFTPAddr returns the address the TFTP server is bound to, the zero value when it is
+// disabled or the Server is not started.
+func (s *Server) TFTPAddr() netaddr.IPPort {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.tconn == nil {
+		return netaddr.IPPort{}
+	}
+	return addrPort(s.tconn.LocalAddr())
+}
+
+// HTTPAddr returns the address the HTTP server is bound to, the zero value when it is
+// disabled or the Server is not started.
+func (s *Server) HTTPAddr() netaddr.IPPort {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.hconn == nil {
+		return netaddr.IPPort{}
+	}
+	return addrPort(s.hconn.Addr())
+}
+
+// MetricsAddr returns the address the metrics server is bound to, the zero value when it is
+// disabled or the Server is not started.
+func (s *Server) MetricsAddr() netaddr.IPPort {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.mconn == nil {
+		return netaddr.IPPort{}
+	}
+	return addrPort(s.mconn.Addr())
+}
+
+// addrPort returns the IP and port of a UDP or TCP address.
+func addrPort(a net.Addr) netaddr.IPPort {
+	var ipp netaddr.IPPort
+	switch a := a.(type) {
+	case *net.UDPAddr:
+		ipp, _ = netaddr.FromStdAddr(a.IP, a.Port, a.Zone)
+	case *net.TCPAddr:
+		ipp, _ = netaddr.FromStdAddr(a.IP, a.Port, a.Zone)
+	}
+	return ipp
+}
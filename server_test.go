@@ -0,0 +1,344 @@
+package ipxe
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/google/go-cmp/cmp"
+	"inet.af/netaddr"
+)
+
+func TestServer(t *testing.T) {
+	content := []byte("ipxe")
+	loopback := netaddr.IPPortFrom(netaddr.IPv4(127, 0, 0, 1), 0)
+	s, err := NewServer(Config{
+		TFTP:  TFTP{Addr: loopback},
+		HTTP:  HTTP{Addr: loopback},
+		Files: MapSource{"ipxe.efi": content},
+		Log:   logr.Discard(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !s.TFTPAddr().IsZero() || !s.HTTPAddr().IsZero() {
+		t.Fatal("expected no addresses before Start")
+	}
+	if err := s.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Start(context.Background()); err == nil {
+		t.Fatal("expected an error starting twice")
+	}
+
+	if s.TFTPAddr().Port() == 0 || s.HTTPAddr().Port() == 0 {
+		t.Fatalf("expected bound ports, got tftp: %v, http: %v", s.TFTPAddr(), s.HTTPAddr())
+	}
+	got, _, err := tftpGet(s.TFTPAddr().String(), "ipxe.efi", nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(got, content); diff != "" {
+		t.Fatal(diff)
+	}
+	resp, err := http.Get("http://" + s.HTTPAddr().String() + "/ipxe.efi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(got, content); diff != "" {
+		t.Fatal(diff)
+	}
+
+	select {
+	case <-s.Done():
+		t.Fatal("expected the server to be serving")
+	default:
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-s.Done():
+	default:
+		t.Fatal("expected Done to be closed after Shutdown")
+	}
+	if err := s.Err(); err != nil {
+		t.Fatal(err)
+	}
+	// shutting down again is a no-op.
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestServer_ContextCanceled(t *testing.T) {
+	s, err := NewServer(Config{
+		TFTP: TFTP{Disabled: true},
+		HTTP: HTTP{Addr: netaddr.IPPortFrom(netaddr.IPv4(127, 0, 0, 1), 0)},
+		Log:  logr.Discard(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := s.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if !s.TFTPAddr().IsZero() {
+		t.Fatalf("expected no tftp address, got: %v", s.TFTPAddr())
+	}
+	cancel()
+	select {
+	case <-s.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("server did not stop after the context was canceled")
+	}
+	if err := s.Err(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestServer_ShutdownDeadline(t *testing.T) {
+	release := make(chan struct{})
+	s, err := NewServer(Config{
+		TFTP:  TFTP{Disabled: true},
+		HTTP:  HTTP{Addr: netaddr.IPPortFrom(netaddr.IPv4(127, 0, 0, 1), 0)},
+		Files: blockingSource{release},
+		Log:   logr.Discard(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer close(release)
+
+	// a request that is in progress until release is closed.
+	started := make(chan struct{})
+	go func() {
+		close(started)
+		if resp, err := http.Get("http://" + s.HTTPAddr().String() + "/ipxe.efi"); err == nil {
+			resp.Body.Close()
+		}
+	}()
+	<-started
+	time.Sleep(100 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("error mismatch, got: %v, want: %v", err, context.DeadlineExceeded)
+	}
+	select {
+	case <-s.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("server did not stop after the drain deadline")
+	}
+}
+
+func TestServer_Metrics(t *testing.T) {
+	loopback := netaddr.IPPortFrom(netaddr.IPv4(127, 0, 0, 1), 0)
+	s, err := NewServer(Config{
+		TFTP:    TFTP{Addr: loopback},
+		HTTP:    HTTP{Disabled: true},
+		Metrics: Metrics{Addr: loopback},
+		Log:     logr.Discard(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Shutdown(context.Background())
+
+	// the listener is bound by Start, the first request does not need to be retried.
+	for _, p := range []string{MetricsPath, HealthzPath, ReadyzPath} {
+		resp, err := http.Get("http://" + s.MetricsAddr().String() + p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("%v status, got: %v, want: %v", p, resp.StatusCode, http.StatusOK)
+		}
+	}
+}
+
+func TestServer_ListenError(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	loopback := netaddr.IPPortFrom(netaddr.IPv4(127, 0, 0, 1), 0)
+	s, err := NewServer(Config{
+		TFTP:    TFTP{Addr: loopback},
+		HTTP:    HTTP{Addr: loopback},
+		Metrics: Metrics{Addr: netaddr.MustParseIPPort(l.Addr().String())},
+		Log:     logr.Discard(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Start(context.Background()); err == nil {
+		t.Fatal("expected an error binding the metrics address in use")
+	}
+	if !s.TFTPAddr().IsZero() || !s.HTTPAddr().IsZero() || !s.MetricsAddr().IsZero() {
+		t.Fatal("expected the bound listeners to be closed")
+	}
+	if s.hl.isReady() {
+		t.Fatal("expected the server not to be ready")
+	}
+}
+
+// blockingSource is a FileSource that blocks opening files until its channel is closed.
+type blockingSource struct {
+	release chan struct{}
+}
+
+func (b blockingSource) Open(name string) (*File, error) {
+	<-b.release
+	return NewFile(name, []byte("ipxe"), time.Time{}), nil
+}
+
+func TestServer_Reload(t *testing.T) {
+	loopback := netaddr.IPPortFrom(netaddr.IPv4(127, 0, 0, 1), 0)
+	c := Config{
+		TFTP:  TFTP{Addr: loopback},
+		HTTP:  HTTP{Addr: loopback},
+		Files: MapSource{"ipxe.efi": []byte("one")},
+		Log:   logr.Discard(),
+	}
+	s, err := NewServer(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Shutdown(context.Background())
+	tftpAddr, httpAddr := s.TFTPAddr(), s.HTTPAddr()
+
+	get := func() (int, string) {
+		t.Helper()
+		resp, err := http.Get("http://" + httpAddr.String() + "/ipxe.efi")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		b, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode, string(b)
+	}
+	if _, got := get(); got != "one" {
+		t.Fatalf("got %q, want %q", got, "one")
+	}
+
+	c.Files = MapSource{"ipxe.efi": []byte("two")}
+	if err := s.Reload(c); err != nil {
+		t.Fatal(err)
+	}
+	if _, got := get(); got != "two" {
+		t.Fatalf("got %q, want %q", got, "two")
+	}
+	got, _, err := tftpGet(tftpAddr.String(), "ipxe.efi", nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(string(got), "two"); diff != "" {
+		t.Fatal(diff)
+	}
+
+	// an invalid configuration keeps the previous one.
+	bad := c
+	bad.Files = MapSource{"ipxe.efi": []byte("three")}
+	bad.TFTP.Uploads = &Uploads{Dir: "/does/not/exist"}
+	if err := s.Reload(bad); err == nil {
+		t.Fatal("expected an error reloading an invalid configuration")
+	}
+	if _, got := get(); got != "two" {
+		t.Fatalf("got %q, want %q", got, "two")
+	}
+
+	// the listeners are not changed.
+	deny, err := ParseIPSet([]string{"127.0.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.ACL = &ACL{Deny: deny}
+	c.HTTP.Addr = netaddr.IPPortFrom(netaddr.IPv4(127, 0, 0, 1), 1)
+	var restart []interface{}
+	c.Log = logr.New(&captureSink{msg: "setting changed, it is only applied by a restart", fn: func(kv []interface{}) {
+		restart = append(restart, kv...)
+	}})
+	if err := s.Reload(c); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(restart, []interface{}{"setting", "HTTP.Addr"}); diff != "" {
+		t.Fatal(diff)
+	}
+	if status, _ := get(); status != http.StatusForbidden {
+		t.Fatalf("got status %v, want %v", status, http.StatusForbidden)
+	}
+	if s.TFTPAddr() != tftpAddr || s.HTTPAddr() != httpAddr {
+		t.Fatalf("listeners changed, got tftp: %v, http: %v, want tftp: %v, http: %v", s.TFTPAddr(), s.HTTPAddr(), tftpAddr, httpAddr)
+	}
+}
+
+func TestRestartSettings(t *testing.T) {
+	addr := netaddr.IPPortFrom(netaddr.IPv4(127, 0, 0, 1), 69)
+	old := Config{
+		TFTP:      TFTP{Addr: addr, Backoff: ConstantBackoff(0)},
+		ProxyDHCP: ProxyDHCP{Enabled: true},
+	}
+	tests := []struct {
+		name   string
+		change func(c *Config)
+		want   []string
+	}{
+		{name: "unchanged", change: func(c *Config) {}},
+		{name: "reloaded", change: func(c *Config) {
+			c.TFTP.Uploads = &Uploads{Dir: "/tmp"}
+			c.TFTP.Limits = &Limiter{MaxTransfers: 1}
+			c.HTTP.Limits = &Limiter{MaxTransfers: 1}
+			c.TFTP.Backoff = ConstantBackoff(time.Second)
+			c.ACL = &ACL{}
+			c.DrainTimeout = time.Second
+		}},
+		{name: "listeners", change: func(c *Config) {
+			c.TFTP.Addr = netaddr.IPPortFrom(netaddr.IPv4(127, 0, 0, 1), 6969)
+			c.HTTP.Disabled = true
+			c.Metrics.Addr = addr
+		}, want: []string{"TFTP.Addr", "HTTP.Disabled", "Metrics.Addr"}},
+		{name: "settings", change: func(c *Config) {
+			c.TFTP.WindowSize = 8
+			c.HTTP.WriteTimeout = time.Second
+			c.ProxyDHCP.Enabled = false
+			c.ProxyDHCP.IPXEScriptURL = "http://127.0.0.1/auto.ipxe"
+		}, want: []string{"TFTP.WindowSize", "HTTP.WriteTimeout", "ProxyDHCP.Enabled", "ProxyDHCP.IPXEScriptURL"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := old
+			tt.change(&c)
+			if diff := cmp.Diff(restartSettings(old, c), tt.want); diff != "" {
+				t.Fatal(diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,102 @@
+package ipxe
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/jacobweinstock/ipxe/binary"
+)
+
+// File is a file to be served over TFTP or HTTP.
+type File struct {
+	io.ReadSeekCloser
+	// Name is the name the file was opened with.
+	Name string
+	// Size is the length of the file in bytes.
+	Size int64
+	// ModTime is the modification time of the file. It is the zero time when unknown.
+	ModTime time.Time
+}
+
+// FileSource is a source of files to be served over TFTP and HTTP.
+type FileSource interface {
+	// Open returns the named file.
+	// If the file does not exist the returned error must wrap os.ErrNotExist.
+	Open(name string) (*File, error)
+}
+
+// MapSource is a FileSource backed by an in memory map of file names to file contents.
+type MapSource map[string][]byte
+
+// Open implements FileSource.
+func (m MapSource) Open(name string) (*File, error) {
+	content, ok := m[name]
+	if !ok {
+		return nil, fmt.Errorf("%q: %w", name, os.ErrNotExist)
+	}
+	return NewFile(name, content, time.Time{}), nil
+}
+
+// NewFile returns a File that reads from content.
+func NewFile(name string, content []byte, modTime time.Time) *File {
+	return &File{
+		ReadSeekCloser: nopCloser{bytes.NewReader(content)},
+		Name:           name,
+		Size:           int64(len(content)),
+		ModTime:        modTime,
+	}
+}
+
+// startTime is used as the modification time of the embedded iPXE binaries, they can not change while running.
+var startTime = time.Now()
+
+// EmbeddedSource returns a FileSource for the iPXE binaries embedded in the binary package.
+func EmbeddedSource() FileSource {
+	return embeddedSource{MapSource(binary.Files)}
+}
+
+type embeddedSource struct {
+	MapSource
+}
+
+// Open implements FileSource.
+func (e embeddedSource) Open(name string) (*File, error) {
+	f, err := e.MapSource.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	f.ModTime = startTime
+	return f, nil
+}
+
+// sortedNames returns the file names in m, sorted.
+func sortedNames(m map[string][]byte) []string {
+	names, _ := MapSource(m).List()
+	return names
+}
+
+// sourceOrDefault returns fs, or the embedded iPXE binaries when fs is nil.
+func sourceOrDefault(fs FileSource) FileSource {
+	if fs == nil {
+		return EmbeddedSource()
+	}
+	return fs
+}
+
+// orDiscard returns l, or a logger that discards everything when l is the zero value.
+func orDiscard(l logr.Logger) logr.Logger {
+	if l.GetSink() == nil {
+		return logr.Discard()
+	}
+	return l
+}
+
+type nopCloser struct {
+	io.ReadSeeker
+}
+
+func (nopCloser) Close() error { return nil }
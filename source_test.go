@@ -0,0 +1,70 @@
+package ipxe
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/go-logr/logr"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestMapSource_Open(t *testing.T) {
+	tests := []struct {
+		name    string
+		src     MapSource
+		file    string
+		want    []byte
+		wantErr error
+	}{
+		{
+			name: "success",
+			src:  MapSource{"custom.efi": []byte("custom")},
+			file: "custom.efi",
+			want: []byte("custom"),
+		},
+		{
+			name:    "not found",
+			src:     MapSource{"custom.efi": []byte("custom")},
+			file:    "ipxe.efi",
+			wantErr: os.ErrNotExist,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := tt.src.Open(tt.file)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("error mismatch, got: %v, want: %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			defer f.Close()
+			got, err := ioutil.ReadAll(f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(got, tt.want); diff != "" {
+				t.Fatal(diff)
+			}
+			if f.Size != int64(len(tt.want)) {
+				t.Fatalf("size mismatch, got: %v, want: %v", f.Size, len(tt.want))
+			}
+		})
+	}
+}
+
+func TestHandleTFTP_ReadHandlerFileSource(t *testing.T) {
+	ht := &HandleTFTP{Log: logr.Discard(), Files: MapSource{"custom.efi": []byte("custom binary")}}
+	rf := &fakeReaderFrom{content: make([]byte, len("custom binary"))}
+	if err := ht.ReadHandler("custom.efi", rf); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(string(rf.content), "custom binary"); diff != "" {
+		t.Fatal(diff)
+	}
+	if err := ht.ReadHandler("snp.efi", rf); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("error mismatch, got: %v, want: %v", err, os.ErrNotExist)
+	}
+}
@@ -1,8 +1,8 @@
 package ipxe
 
 import (
-	"bytes"
 	"context"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"net"
@@ -10,9 +10,11 @@ import (
 	"path"
 	"path/filepath"
 	"regexp"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/go-logr/logr"
-	"github.com/jacobweinstock/ipxe/binary"
 	"github.com/pin/tftp"
 	"github.com/pkg/errors"
 	"go.opentelemetry.io/otel"
@@ -25,6 +27,172 @@ import (
 // HandleTFTP is the struct that implements the TFTP read and write function handlers.
 type HandleTFTP struct {
 	Log logr.Logger
+	// Files is the source of files to serve. Defaults to the embedded iPXE binaries.
+	Files FileSource
+	// Hook, when set, must also be set on the tftp.Server with SetHook. It gives ReadHandler
+	// the block size and retransmissions of each transfer to record on its trace span.
+	Hook *TFTPHook
+	// Uploads, when set, enables TFTP write requests.
+	Uploads *Uploads
+	// ACL, when set, controls which clients are served.
+	ACL *ACL
+	// Limits, when set, caps the concurrent transfers and request rate of read and write requests.
+	Limits *Limiter
+	// Transfers, when set, tracks the transfers in progress so a shutdown can drain them.
+	Transfers *Transfers
+}
+
+// TFTPHook is a tftp.Hook that hands the statistics of each transfer to HandleTFTP.ReadHandler.
+type TFTPHook struct {
+	mu sync.Mutex
+	// stats holds the transfers in progress, a nil value until the transfer finishes.
+	stats map[tftpTransfer]*tftp.TransferStats
+	// called is closed by the first call of OnSuccess or OnFailure.
+	called chan struct{}
+}
+
+type tftpTransfer struct {
+	addr     string
+	filename string
+}
+
+func newTFTPTransfer(ip net.IP, port int, filename string) tftpTransfer {
+	return tftpTransfer{addr: (&net.UDPAddr{IP: ip, Port: port}).String(), filename: filename}
+}
+
+// OnSuccess implements tftp.Hook.
+func (h *TFTPHook) OnSuccess(stats tftp.TransferStats) {
+	h.put(stats)
+}
+
+// OnFailure implements tftp.Hook.
+func (h *TFTPHook) OnFailure(stats tftp.TransferStats, _ error) {
+	h.put(stats)
+}
+
+// put stores stats for a transfer started with begin, other transfers are ignored.
+func (h *TFTPHook) put(stats tftp.TransferStats) {
+	k := newTFTPTransfer(stats.RemoteAddr, stats.Tid, stats.Filename)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	select {
+	case <-h.calledLocked():
+	default:
+		close(h.called)
+	}
+	if _, ok := h.stats[k]; ok {
+		h.stats[k] = &stats
+	}
+}
+
+// begin starts collecting the statistics of the transfer of filename to addr.
+func (h *TFTPHook) begin(addr net.UDPAddr, filename string) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.stats == nil {
+		h.stats = make(map[tftpTransfer]*tftp.TransferStats)
+	}
+	h.stats[newTFTPTransfer(addr.IP, addr.Port, filename)] = nil
+}
+
+// end returns the statistics of the transfer of filename to addr, started with begin.
+func (h *TFTPHook) end(addr net.UDPAddr, filename string) (*tftp.TransferStats, bool) {
+	if h == nil {
+		return nil, false
+	}
+	k := newTFTPTransfer(addr.IP, addr.Port, filename)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	stats := h.stats[k]
+	delete(h.stats, k)
+	return stats, stats != nil
+}
+
+// serving returns a channel closed once the hook has been called. pin/tftp only calls it once
+// Serve is set up, from the goroutines of Serve and the transfers it starts.
+func (h *TFTPHook) serving() <-chan struct{} {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.calledLocked()
+}
+
+// calledLocked returns h.called, making it when needed. h.mu must be held.
+func (h *TFTPHook) calledLocked() chan struct{} {
+	if h.called == nil {
+		h.called = make(chan struct{})
+	}
+	return h.called
+}
+
+// shutdownTFTP closes conn, the conn s serves from, and shuts s down. hook must be set on s,
+// served is closed when Serve returns.
+//
+// pin/tftp sets up the server in Serve without synchronisation, a Shutdown before Serve is done
+// with that is a data race, and can block forever. Once conn is closed, Serve calls hook with the
+// error of every read, so Shutdown is only called after the hook.
+func shutdownTFTP(s *tftp.Server, conn io.Closer, hook *TFTPHook, served <-chan struct{}) {
+	_ = conn.Close()
+	select {
+	case <-hook.serving():
+	case <-served:
+		return
+	}
+	s.Shutdown()
+}
+
+// ConstantBackoff waits d before every retransmission.
+func ConstantBackoff(d time.Duration) func(attempt int) time.Duration {
+	return func(int) time.Duration { return d }
+}
+
+// ExponentialBackoff waits base before the first retransmission, doubling for every
+// following attempt up to limit. A limit of 0 means no limit.
+func ExponentialBackoff(base, limit time.Duration) func(attempt int) time.Duration {
+	return func(attempt int) time.Duration {
+		d := base
+		for i := 0; i < attempt; i++ {
+			if limit > 0 && d >= limit {
+				break
+			}
+			d *= 2
+		}
+		if limit > 0 && d > limit {
+			return limit
+		}
+		return d
+	}
+}
+
+// ParseBackoff parses a TFTP retransmission backoff policy: "random" for pin/tftp's default
+// of a random duration of up to one second, "constant:<duration>" or
+// "exponential:<base>[:<max>]". It returns nil for "random".
+func ParseBackoff(s string) (func(attempt int) time.Duration, error) {
+	parts := strings.Split(s, ":")
+	durations := make([]time.Duration, 0, len(parts)-1)
+	for _, p := range parts[1:] {
+		d, err := time.ParseDuration(p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid backoff %q: %w", s, err)
+		}
+		if d <= 0 {
+			return nil, fmt.Errorf("invalid backoff %q: durations must be positive", s)
+		}
+		durations = append(durations, d)
+	}
+	switch {
+	case strings.EqualFold(parts[0], "random") && len(durations) == 0:
+		return nil, nil
+	case strings.EqualFold(parts[0], "constant") && len(durations) == 1:
+		return ConstantBackoff(durations[0]), nil
+	case strings.EqualFold(parts[0], "exponential") && len(durations) == 1:
+		return ExponentialBackoff(durations[0], 0), nil
+	case strings.EqualFold(parts[0], "exponential") && len(durations) == 2:
+		return ExponentialBackoff(durations[0], durations[1]), nil
+	}
+	return nil, fmt.Errorf("unknown backoff %q, must be random, constant:<duration> or exponential:<base>[:<max>]", s)
 }
 
 // ListenAndServeTFTP sets up the listener on the given address and serves TFTP requests.
@@ -47,6 +215,7 @@ func ServeTFTP(_ context.Context, conn net.PacketConn, s *tftp.Server) error {
 
 // ReadHandler handlers TFTP GET requests.
 func (t HandleTFTP) ReadHandler(filename string, rf io.ReaderFrom) error {
+	start := time.Now()
 	client := net.UDPAddr{}
 	if rpi, ok := rf.(tftp.OutgoingTransfer); ok {
 		client = rpi.RemoteAddr()
@@ -69,47 +238,164 @@ func (t HandleTFTP) ReadHandler(filename string, rf io.ReaderFrom) error {
 		filename = shortfile
 	}
 	tracer := otel.Tracer("TFTP")
-	_, span := tracer.Start(ctx, "TFTP get",
+	ctx, span := tracer.Start(ctx, "TFTP get",
 		trace.WithSpanKind(trace.SpanKindServer),
 		trace.WithAttributes(attribute.String("filename", filename)),
 		trace.WithAttributes(attribute.String("requested-filename", longfile)),
 		trace.WithAttributes(attribute.String("IP", client.IP.String())),
 	)
+	defer span.End()
 
 	// parse mac from the full filename
 	mac, _ := net.ParseMAC(path.Dir(full))
 	l = l.WithValues("mac", mac.String())
+	span.SetAttributes(attribute.String("mac", mac.String()))
 
-	span.SetStatus(codes.Ok, filename)
-	span.End()
-
-	content, ok := binary.Files[filepath.Base(filename)]
-	if !ok {
-		err := errors.Wrap(os.ErrNotExist, "file unknown")
-		l.Error(err, "file unknown")
+	ip, _ := netaddr.FromStdIP(client.IP)
+	ctx = WithClient(ctx, Client{IP: ip})
+	r := newRequest(ctx, protocolTFTP, filename, ip)
+	if err := t.ACL.Check(ip, mac); err != nil {
+		l.Info("access denied", "reason", err.Error())
+		r.done(outcomeDenied, 0)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return err
+	}
+	release, err := t.Limits.acquire(ip, t.Limits.queueTimeout())
+	if err != nil {
+		l.Info("request limited", "reason", err.Error())
+		r.done(outcomeLimited, 0)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
 		return err
 	}
-	ct := bytes.NewReader(content)
+	defer release()
+	aborted, end, err := t.Transfers.begin()
+	if err != nil {
+		l.Info("transfer refused", "reason", err.Error())
+		r.done(outcomeError, 0)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return err
+	}
+	defer end()
+	f, err := openFor(ctx, t.Files, filepath.Base(filename), mac)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			err = errors.Wrap(err, "file unknown")
+			l.Error(err, "file unknown")
+			r.done(outcomeNotFound, 0)
+		} else {
+			l.Error(err, "file open failed")
+			r.done(outcomeError, 0)
+		}
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return err
+	}
+	defer f.Close()
+	f.ReadSeekCloser = abortReader{ReadSeekCloser: f.ReadSeekCloser, aborted: aborted}
 
-	b, err := rf.ReadFrom(ct)
+	r.started(f)
+	t.Hook.begin(client, full)
+	tftpActiveTransfers.Inc()
+	b, err := rf.ReadFrom(f)
+	tftpActiveTransfers.Dec()
+	span.SetAttributes(
+		attribute.Int64("bytes-sent", b),
+		attribute.Int64("content-size", f.Size),
+		attribute.Int64("duration-ms", time.Since(start).Milliseconds()),
+	)
+	if stats, ok := t.Hook.end(client, full); ok {
+		blksize := stats.Opts["blksize"]
+		if blksize == "" {
+			blksize = "512"
+		}
+		windowsize := stats.Opts["windowsize"]
+		if windowsize == "" {
+			windowsize = "1"
+		}
+		span.SetAttributes(
+			attribute.String("blksize", blksize),
+			attribute.String("windowsize", windowsize),
+			attribute.Int("datagrams-sent", stats.DatagramsSent),
+			attribute.Int("retransmissions", stats.DatagramsSent-stats.DatagramsAcked),
+		)
+	}
 	if err != nil {
-		l.Error(err, "file serve failed", "EOF", errors.Is(err, io.EOF), "b", b, "content size", len(content))
+		l.Error(err, "file serve failed", "EOF", errors.Is(err, io.EOF), "b", b, "content size", f.Size)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		r.done(outcomeError, b)
 		return err
 	}
-	l.Info("file served", "bytes sent", b, "content size", len(content))
+	r.done(outcomeOK, b)
+	l.Info("file served", "bytes sent", b, "content size", f.Size)
+	span.SetStatus(codes.Ok, filename)
 	return nil
 }
 
-// WriteHandler handles TFTP PUT requests. It will always return an error. This library does not support PUT.
+// WriteHandler handles TFTP PUT requests. Unless Uploads is set it always returns an error.
 func (t HandleTFTP) WriteHandler(filename string, wt io.WriterTo) error {
-	err := errors.Wrap(os.ErrPermission, "access_violation")
 	client := net.UDPAddr{}
-	if rpi, ok := wt.(tftp.OutgoingTransfer); ok {
+	if rpi, ok := wt.(interface{ RemoteAddr() net.UDPAddr }); ok {
 		client = rpi.RemoteAddr()
 	}
-	t.Log.Error(err, "client", client, "event", "put", "filename", filename)
+	l := t.Log.WithValues("client", client, "event", "put", "filename", filename)
+	mac, _ := net.ParseMAC(path.Dir(filename))
+	ip, _ := netaddr.FromStdIP(client.IP)
+	// uploads are recorded like reads that did not open a file, the names clients upload are not recorded.
+	r := newRequest(WithClient(context.Background(), Client{IP: ip}), protocolTFTP, "", ip)
+	if t.Uploads == nil {
+		err := errors.Wrap(os.ErrPermission, "access_violation")
+		l.Error(err, "")
+		r.done(outcomeError, 0)
+		return err
+	}
 
-	return err
+	// the same checks as ReadHandler, in the same order.
+	if err := t.ACL.Check(ip, mac); err != nil {
+		l.Info("access denied", "reason", err.Error())
+		r.done(outcomeDenied, 0)
+		return err
+	}
+	release, err := t.Limits.acquire(ip, t.Limits.queueTimeout())
+	if err != nil {
+		l.Info("request limited", "reason", err.Error())
+		r.done(outcomeLimited, 0)
+		return err
+	}
+	defer release()
+	aborted, end, err := t.Transfers.begin()
+	if err != nil {
+		l.Info("transfer refused", "reason", err.Error())
+		r.done(outcomeError, 0)
+		return err
+	}
+	defer end()
+	name, err := SanitizeUploadName(filename)
+	if err != nil {
+		l.Error(err, "upload refused")
+		r.done(outcomeError, 0)
+		return err
+	}
+	var size int64
+	var sizeKnown bool
+	if it, ok := wt.(tftp.IncomingTransfer); ok {
+		size, sizeKnown = it.Size()
+	}
+
+	tftpActiveTransfers.Inc()
+	up, err := t.Uploads.receive(abortWriterTo{WriterTo: wt, aborted: aborted}, size, sizeKnown, name, mac, ip)
+	tftpActiveTransfers.Dec()
+	if err != nil {
+		l.Error(err, "upload failed")
+		r.done(outcomeError, 0)
+		return err
+	}
+	r.done(outcomeOK, 0)
+	l.Info("file received", "path", up.Path, "bytes received", up.Size)
+	return nil
 }
 
 // extractTraceparentFromFilename takes a context and filename and checks the filename for
@@ -132,12 +418,17 @@ func extractTraceparentFromFilename(ctx context.Context, filename string) (conte
 			return ctx, filename, fmt.Errorf("parsing OpenTelemetry span id %q failed: %w", parts[3], err)
 		}
 
-		// create a span context with the parent trace id & span id
+		flags, err := hex.DecodeString(parts[4])
+		if err != nil {
+			return ctx, filename, fmt.Errorf("parsing OpenTelemetry trace flags %q failed: %w", parts[4], err)
+		}
+
+		// create a span context with the parent trace id, span id & trace flags
 		spanCtx := trace.NewSpanContext(trace.SpanContextConfig{
 			TraceID:    traceID,
 			SpanID:     spanID,
 			Remote:     true,
-			TraceFlags: trace.FlagsSampled, // TODO: use the parts[4] value instead
+			TraceFlags: trace.TraceFlags(flags[0]),
 		})
 
 		// inject it into the context.Context and return it along with the original filename
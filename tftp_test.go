@@ -3,9 +3,11 @@ package ipxe
 import (
 	"context"
 	"errors"
+	"fmt"
 	"io"
 	"net"
 	"os"
+	"strconv"
 	"testing"
 	"time"
 
@@ -13,12 +15,15 @@ import (
 	"github.com/google/go-cmp/cmp"
 	"github.com/jacobweinstock/ipxe/binary"
 	"github.com/pin/tftp"
+	"go.opentelemetry.io/otel/trace"
 	"inet.af/netaddr"
 )
 
 func TestListenAndServeTFTP(t *testing.T) {
 	ht := &HandleTFTP{Log: logr.Discard()}
 	srv := tftp.NewServer(ht.ReadHandler, ht.WriteHandler)
+	hook := &TFTPHook{}
+	srv.SetHook(hook)
 	type args struct {
 		ctx  context.Context
 		addr netaddr.IPPort
@@ -57,7 +62,20 @@ func TestListenAndServeTFTP(t *testing.T) {
 
 			if tt.args.h != nil {
 				tt.args.ctx.Done()
-				time.Sleep(time.Second)
+				// an invalid packet makes the server call the hook, Shutdown must not be called before.
+				conn, err := net.Dial("udp", tt.args.addr.String())
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer conn.Close()
+				for serving := false; !serving; {
+					_, _ = conn.Write([]byte{0})
+					select {
+					case <-hook.serving():
+						serving = true
+					case <-time.After(10 * time.Millisecond):
+					}
+				}
 				tt.args.h.Shutdown()
 			}
 			err := <-errChan
@@ -111,3 +129,191 @@ func (f *fakeReaderFrom) RemoteAddr() net.UDPAddr {
 func (f *fakeReaderFrom) WriteTo(_ io.Writer) (n int64, err error) {
 	return 0, nil
 }
+
+func TestTFTPHook(t *testing.T) {
+	h := &TFTPHook{}
+	addr := net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9999}
+	h.begin(addr, "aa:bb:cc:dd:ee:ff/ipxe.efi")
+	// transfers that were not started with begin are ignored.
+	h.OnFailure(tftp.TransferStats{RemoteAddr: addr.IP, Tid: 1234, Filename: "ipxe.efi"}, errors.New("failed"))
+	h.OnSuccess(tftp.TransferStats{RemoteAddr: addr.IP.To4(), Tid: addr.Port, Filename: "aa:bb:cc:dd:ee:ff/ipxe.efi", DatagramsSent: 12, DatagramsAcked: 10})
+
+	got, ok := h.end(addr, "aa:bb:cc:dd:ee:ff/ipxe.efi")
+	if !ok {
+		t.Fatal("expected transfer stats")
+	}
+	if got.DatagramsSent-got.DatagramsAcked != 2 {
+		t.Fatalf("got %v retransmissions, want 2", got.DatagramsSent-got.DatagramsAcked)
+	}
+	if _, ok := h.end(addr, "aa:bb:cc:dd:ee:ff/ipxe.efi"); ok {
+		t.Fatal("expected stats to be removed")
+	}
+	if diff := cmp.Diff(len(h.stats), 0); diff != "" {
+		t.Fatal(diff)
+	}
+
+	// a nil hook is a no-op.
+	var nilHook *TFTPHook
+	nilHook.begin(addr, "ipxe.efi")
+	if _, ok := nilHook.end(addr, "ipxe.efi"); ok {
+		t.Fatal("expected no stats from a nil hook")
+	}
+}
+
+func TestExtractTraceparentFromFilename(t *testing.T) {
+	tests := []struct {
+		name      string
+		filename  string
+		wantFile  string
+		wantFlags trace.TraceFlags
+		wantValid bool
+	}{
+		{name: "none", filename: "ipxe.efi", wantFile: "ipxe.efi"},
+		{name: "sampled", filename: "ipxe.efi-00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01", wantFile: "ipxe.efi", wantFlags: trace.FlagsSampled, wantValid: true},
+		{name: "not sampled", filename: "ipxe.efi-00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-00", wantFile: "ipxe.efi", wantValid: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, file, err := extractTraceparentFromFilename(context.Background(), tt.filename)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(file, tt.wantFile); diff != "" {
+				t.Fatal(diff)
+			}
+			sc := trace.SpanContextFromContext(ctx)
+			if sc.IsValid() != tt.wantValid {
+				t.Fatalf("valid span context, got: %v, want: %v", sc.IsValid(), tt.wantValid)
+			}
+			if sc.TraceFlags() != tt.wantFlags {
+				t.Fatalf("trace flags, got: %v, want: %v", sc.TraceFlags(), tt.wantFlags)
+			}
+		})
+	}
+}
+
+func TestHandlerTFTP_ReadHandlerUnknown(t *testing.T) {
+	ht := &HandleTFTP{Log: logr.Discard(), Hook: &TFTPHook{}}
+	rf := &fakeReaderFrom{addr: net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9999}}
+	if err := ht.ReadHandler("missing.efi", rf); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("error mismatch, got: %v, want: %v", err, os.ErrNotExist)
+	}
+	if diff := cmp.Diff(len(ht.Hook.stats), 0); diff != "" {
+		t.Fatal(diff)
+	}
+}
+
+func TestParseBackoff(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    []time.Duration
+		wantErr bool
+	}{
+		{in: "random"},
+		{in: "constant:250ms", want: []time.Duration{250 * time.Millisecond, 250 * time.Millisecond, 250 * time.Millisecond}},
+		{in: "exponential:100ms", want: []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond}},
+		{in: "Exponential:100ms:300ms", want: []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 300 * time.Millisecond}},
+		{in: "constant", wantErr: true},
+		{in: "constant:-1s", wantErr: true},
+		{in: "exponential:1s:2s:3s", wantErr: true},
+		{in: "random:1s", wantErr: true},
+		{in: "linear:1s", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			b, err := ParseBackoff(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got err: %v, wantErr: %v", err, tt.wantErr)
+			}
+			if tt.want == nil {
+				if b != nil {
+					t.Fatal("expected no backoff func")
+				}
+				return
+			}
+			var got []time.Duration
+			for i := range tt.want {
+				got = append(got, b(i))
+			}
+			if diff := cmp.Diff(got, tt.want); diff != "" {
+				t.Fatal(diff)
+			}
+		})
+	}
+}
+
+// statsHook is a tftp.Hook that sends the stats of every successful transfer.
+type statsHook chan tftp.TransferStats
+
+func (h statsHook) OnSuccess(stats tftp.TransferStats) { h <- stats }
+
+func (h statsHook) OnFailure(tftp.TransferStats, error) {}
+
+func TestTFTP_Configure(t *testing.T) {
+	content := make([]byte, 3000)
+	h := HandleTFTP{Log: logr.Discard(), Files: MapSource{"ipxe.efi": content}}
+	s := tftp.NewServer(h.ReadHandler, h.WriteHandler)
+	hook := make(statsHook, 1)
+	s.SetHook(hook)
+	TFTP{Timeout: time.Second, MaxRetries: 2, Backoff: ConstantBackoff(10 * time.Millisecond), BlockSize: 1024, SinglePort: true}.configure(s)
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() { _ = ServeTFTP(context.Background(), conn, s) }()
+	defer func() {
+		conn.Close()
+		s.Shutdown()
+	}()
+
+	c, err := tftp.NewClient(conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SetBlockSize(1400)
+	wt, err := c.Receive("ipxe.efi", "octet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := wt.WriteTo(io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(len(content)) {
+		t.Fatalf("got %v bytes, want %v", n, len(content))
+	}
+
+	// the block size is also limited by the MTU, which pin/tftp falls back to 512 for
+	// when it cannot read it, so only the upper bound is certain.
+	stats := <-hook
+	blksize, err := strconv.Atoi(stats.Opts["blksize"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if blksize < 512 || blksize > 1024 {
+		t.Fatalf("got blksize %v, want between 512 and 1024", blksize)
+	}
+}
+
+// BenchmarkTFTPWindowSize serves snp.efi sized files to a loopback client, lock-step and
+// with increasing window sizes.
+func BenchmarkTFTPWindowSize(b *testing.B) {
+	content := make([]byte, 1<<20)
+	for _, window := range []int{1, 4, 16, 64} {
+		b.Run(fmt.Sprintf("windowsize-%d", window), func(b *testing.B) {
+			addr := serveTestTFTP(b, MapSource{"snp.efi": content}, TFTP{WindowSize: window})
+			opts := map[string]string{"blksize": "1432"}
+			if window > 1 {
+				opts["windowsize"] = strconv.Itoa(window)
+			}
+			b.SetBytes(int64(len(content)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, _, err := tftpGet(addr, "snp.efi", opts, 0); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,531 @@
+package ipxe
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/pin/tftp"
+	"github.com/pkg/errors"
+)
+
+// TFTP opcodes, RFC 1350 and RFC 2347.
+const (
+	tftpRRQ   = 1
+	tftpData  = 3
+	tftpAck   = 4
+	tftpError = 5
+	tftpOACK  = 6
+)
+
+// TFTP error codes, RFC 1350.
+const (
+	tftpErrUndefined    = 0
+	tftpErrFileNotFound = 1
+	tftpErrAccess       = 2
+)
+
+const (
+	// tftpBlockSize is the block size when a client does not negotiate one, RFC 1350.
+	tftpBlockSize = 512
+	// tftpMaxBlockSize is the largest block size a client can negotiate, RFC 2348.
+	tftpMaxBlockSize = 65464
+	// tftpMaxWindowSize is the largest window size a client can negotiate, RFC 7440.
+	tftpMaxWindowSize = 65535
+	// tftpDefaultRetries is the number of attempts to transmit a packet when TFTP.MaxRetries is not set.
+	tftpDefaultRetries = 5
+)
+
+// windowServer serves TFTP octet mode read requests with RFC 7440 windowsize negotiation,
+// which pin/tftp does not support. It wraps the TFTP listen conn, the pin/tftp Server
+// reading from it only sees the other requests, write and netascii read requests.
+//
+// pin/tftp only reads the destination address and interface of requests from a *net.UDPConn,
+// so the requests it gets from a windowServer lose them. Their transfers are sent from an
+// address the routing table picks instead of the one the request was sent to, and their block
+// size is limited to 512 bytes instead of the MTU of the interface. Listen on a specific IP
+// when the host has several, so the source address of the transfers is the one clients expect.
+type windowServer struct {
+	net.PacketConn
+	handler func(filename string, rf io.ReaderFrom) error
+	hook    tftp.Hook
+	cfg     TFTP
+	log     logr.Logger
+
+	mu     sync.Mutex
+	closed bool
+	wg     sync.WaitGroup
+}
+
+// newWindowServer returns a windowServer reading from conn, serving read requests with handler,
+// which is HandleTFTP.ReadHandler. hook is the TFTPHook of the handler, nil when it has none.
+func newWindowServer(conn net.PacketConn, handler func(filename string, rf io.ReaderFrom) error, hook *TFTPHook, cfg TFTP, log logr.Logger) *windowServer {
+	w := &windowServer{PacketConn: conn, handler: handler, cfg: cfg, log: log}
+	if hook != nil {
+		w.hook = hook
+	}
+	return w
+}
+
+// ReadFrom returns the next packet that is not an octet mode read request, those are served
+// by the windowServer.
+func (w *windowServer) ReadFrom(p []byte) (int, net.Addr, error) {
+	for {
+		n, addr, err := w.PacketConn.ReadFrom(p)
+		if err != nil {
+			return n, addr, err
+		}
+		rrq, err := parseTFTPRequest(p[:n])
+		udp, ok := addr.(*net.UDPAddr)
+		if err != nil || !ok || !strings.EqualFold(rrq.mode, "octet") {
+			return n, addr, nil
+		}
+		w.mu.Lock()
+		if w.closed {
+			w.mu.Unlock()
+			return 0, nil, net.ErrClosed
+		}
+		w.wg.Add(1)
+		w.mu.Unlock()
+		go func() {
+			defer w.wg.Done()
+			w.serve(rrq, udp)
+		}()
+	}
+}
+
+// Close stops accepting read requests and closes the listen conn. Transfers in progress
+// carry on, wait returns once they are done.
+func (w *windowServer) Close() error {
+	w.mu.Lock()
+	w.closed = true
+	w.mu.Unlock()
+	return w.PacketConn.Close()
+}
+
+// wait blocks until all transfers are done.
+func (w *windowServer) wait() {
+	w.wg.Wait()
+}
+
+// serve sends the file requested by rrq to addr from a new port.
+func (w *windowServer) serve(rrq tftpRequest, addr *net.UDPAddr) {
+	var laddr *net.UDPAddr
+	if l, ok := w.LocalAddr().(*net.UDPAddr); ok && !l.IP.IsUnspecified() {
+		laddr = &net.UDPAddr{IP: l.IP}
+	}
+	conn, err := net.DialUDP("udp", laddr, addr)
+	if err != nil {
+		w.log.Error(err, "could not open TFTP transfer conn", "client", addr)
+		return
+	}
+	s := newWindowSender(conn, addr, rrq, w.cfg, w.hook)
+	if err := w.handler(rrq.filename, s); err != nil {
+		s.abort(err)
+	}
+	s.close()
+}
+
+// tftpRequest is a parsed read request.
+type tftpRequest struct {
+	filename string
+	mode     string
+	// opts are the requested options, with lower case names.
+	opts map[string]string
+}
+
+// parseTFTPRequest parses a read request, any other packet is an error.
+func parseTFTPRequest(b []byte) (tftpRequest, error) {
+	if len(b) < 4 || binary.BigEndian.Uint16(b) != tftpRRQ || b[len(b)-1] != 0 {
+		return tftpRequest{}, errors.New("not a TFTP read request")
+	}
+	fields := bytes.Split(b[2:len(b)-1], []byte{0})
+	if len(fields) < 2 || len(fields)%2 != 0 {
+		return tftpRequest{}, errors.New("malformed TFTP read request")
+	}
+	r := tftpRequest{filename: string(fields[0]), mode: string(fields[1]), opts: map[string]string{}}
+	for i := 2; i < len(fields); i += 2 {
+		r.opts[strings.ToLower(string(fields[i]))] = string(fields[i+1])
+	}
+	return r, nil
+}
+
+// windowSender sends a file to a client, windowsize blocks at a time. It implements
+// io.ReaderFrom and tftp.OutgoingTransfer, like the pin/tftp sender handed to HandleTFTP.ReadHandler.
+type windowSender struct {
+	conn     *net.UDPConn
+	addr     *net.UDPAddr
+	filename string
+	mode     string
+	// opts are the options acknowledged to the client.
+	opts map[string]string
+
+	blksize int
+	window  int
+	timeout time.Duration
+	retries int
+	backoff func(attempt int) time.Duration
+	hook    tftp.Hook
+
+	start          time.Time
+	datagramsSent  int
+	datagramsAcked int
+	buf            []byte
+	// done is set once the transfer succeeded or was aborted.
+	done bool
+}
+
+// newWindowSender negotiates the options in rrq, limited by cfg and the MTU of conn.
+func newWindowSender(conn *net.UDPConn, addr *net.UDPAddr, rrq tftpRequest, cfg TFTP, hook tftp.Hook) *windowSender {
+	s := &windowSender{
+		conn:     conn,
+		addr:     addr,
+		filename: rrq.filename,
+		mode:     rrq.mode,
+		opts:     map[string]string{},
+		blksize:  tftpBlockSize,
+		window:   1,
+		timeout:  cfg.Timeout,
+		retries:  cfg.MaxRetries,
+		backoff:  cfg.Backoff,
+		hook:     hook,
+		start:    time.Now(),
+	}
+	if s.timeout <= 0 {
+		s.timeout = 5 * time.Second
+	}
+	if s.retries < 1 {
+		s.retries = tftpDefaultRetries
+	}
+	if v, ok := rrq.opts["blksize"]; ok {
+		if n, err := strconv.Atoi(v); err == nil && n >= 8 && n <= tftpMaxBlockSize {
+			if limit := maxBlockSize(conn, cfg.BlockSize); n > limit {
+				n = limit
+			}
+			s.blksize = n
+			s.opts["blksize"] = strconv.Itoa(n)
+		}
+	}
+	if v, ok := rrq.opts["windowsize"]; ok {
+		if n, err := strconv.Atoi(v); err == nil && n >= 1 && n <= tftpMaxWindowSize {
+			if n > cfg.WindowSize {
+				n = cfg.WindowSize
+			}
+			s.window = n
+			s.opts["windowsize"] = strconv.Itoa(n)
+		}
+	}
+	if v, ok := rrq.opts["timeout"]; ok {
+		if n, err := strconv.Atoi(v); err == nil && n >= 1 && n <= 255 {
+			s.timeout = time.Duration(n) * time.Second
+			s.opts["timeout"] = v
+		}
+	}
+	if v, ok := rrq.opts["tsize"]; ok && v == "0" {
+		s.opts["tsize"] = ""
+	}
+	size := 4 + s.blksize
+	if size < tftpBlockSize+4 {
+		size = tftpBlockSize + 4
+	}
+	s.buf = make([]byte, size)
+	return s
+}
+
+// maxBlockSize returns the largest block size that fits in a datagram on the interface
+// conn sends from, and is no larger than limit when limit is set.
+func maxBlockSize(conn *net.UDPConn, limit int) int {
+	size := tftpMaxBlockSize
+	if limit > 0 && limit < size {
+		size = limit
+	}
+	l, ok := conn.LocalAddr().(*net.UDPAddr)
+	if !ok {
+		return size
+	}
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return size
+	}
+	for _, iface := range ifaces {
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, a := range addrs {
+			if n, ok := a.(*net.IPNet); ok && n.IP.Equal(l.IP) {
+				// mtu - ip header - udp header - tftp header
+				mtu := iface.MTU - 20 - 8 - 4
+				if l.IP.To4() == nil {
+					mtu = iface.MTU - 40 - 8 - 4
+				}
+				if mtu >= tftpBlockSize && mtu < size {
+					size = mtu
+				}
+				return size
+			}
+		}
+	}
+	return size
+}
+
+// RemoteAddr returns the address of the client.
+func (s *windowSender) RemoteAddr() net.UDPAddr { return *s.addr }
+
+// SetSize sets the transfer size sent to clients that request it with the tsize option.
+func (s *windowSender) SetSize(n int64) {
+	if _, ok := s.opts["tsize"]; ok {
+		s.opts["tsize"] = strconv.FormatInt(n, 10)
+	}
+}
+
+// ReadFrom sends the contents of r to the client.
+func (s *windowSender) ReadFrom(r io.Reader) (int64, error) {
+	if s.conn == nil {
+		return 0, errors.New("transfer aborted")
+	}
+	if ts, ok := s.opts["tsize"]; ok && ts == "" {
+		if size, err := seekerSize(r); err == nil {
+			s.opts["tsize"] = strconv.FormatInt(size, 10)
+		} else {
+			delete(s.opts, "tsize")
+		}
+	}
+	if len(s.opts) > 0 {
+		if err := s.sendOACK(); err != nil {
+			s.abort(err)
+			return 0, err
+		}
+	}
+	n, err := s.sendData(r)
+	if err != nil {
+		s.abort(err)
+		return n, err
+	}
+	s.done = true
+	if s.hook != nil {
+		s.hook.OnSuccess(s.stats())
+	}
+	return n, nil
+}
+
+// seekerSize returns the size of r when it is an io.Seeker.
+func seekerSize(r io.Reader) (int64, error) {
+	rs, ok := r.(io.Seeker)
+	if !ok {
+		return 0, errors.New("size unknown")
+	}
+	pos, err := rs.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, err
+	}
+	size, err := rs.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := rs.Seek(pos, io.SeekStart); err != nil {
+		return 0, err
+	}
+	return size - pos, nil
+}
+
+// sendOACK acknowledges the negotiated options and waits for the client to acknowledge them with block 0.
+func (s *windowSender) sendOACK() error {
+	p := []byte{0, tftpOACK}
+	for name, value := range s.opts {
+		p = append(p, name...)
+		p = append(p, 0)
+		p = append(p, value...)
+		p = append(p, 0)
+	}
+	for attempt := 0; ; attempt++ {
+		if err := s.write(p); err != nil {
+			return err
+		}
+		acked, err := s.readAck(func(block uint16) int {
+			if block == 0 {
+				return 1
+			}
+			return 0
+		})
+		if err != nil {
+			return err
+		}
+		if acked > 0 {
+			return nil
+		}
+		if attempt+1 >= s.retries {
+			return errors.New("timed out waiting for the client to acknowledge options")
+		}
+		s.wait(attempt)
+	}
+}
+
+// sendData sends the contents of r, a window of blocks at a time. After each window the
+// client acknowledges the last block it received in order, and the next window starts with the block after it.
+func (s *windowSender) sendData(r io.Reader) (int64, error) {
+	var (
+		n int64
+		// pending are the blocks sent but not acknowledged, each with its DATA header.
+		pending [][]byte
+		// free are the buffers of acknowledged blocks, reused for the next ones.
+		free [][]byte
+		// first is the number of the first pending block, counting from 0 without rolling over.
+		first int
+		eof   bool
+	)
+	for attempt := 0; ; {
+		for !eof && len(pending) < s.window {
+			var b []byte
+			if i := len(free) - 1; i >= 0 {
+				b, free = free[i][:4+s.blksize], free[:i]
+			} else {
+				b = make([]byte, 4+s.blksize)
+			}
+			binary.BigEndian.PutUint16(b, tftpData)
+			binary.BigEndian.PutUint16(b[2:], uint16(first+len(pending)+1))
+			l, err := io.ReadFull(r, b[4:])
+			n += int64(l)
+			if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+				return n, err
+			}
+			if l < s.blksize {
+				eof = true
+			}
+			pending = append(pending, b[:4+l])
+		}
+		if len(pending) == 0 {
+			return n, nil
+		}
+		for _, b := range pending {
+			if err := s.write(b); err != nil {
+				return n, err
+			}
+		}
+		acked, err := s.readAck(func(block uint16) int {
+			for i := range pending {
+				if uint16(first+i+1) == block {
+					return i + 1
+				}
+			}
+			return 0
+		})
+		if err != nil {
+			return n, err
+		}
+		if acked > 0 {
+			free = append(free, pending[:acked]...)
+			pending = pending[acked:]
+			first += acked
+			attempt = 0
+			continue
+		}
+		if attempt++; attempt >= s.retries {
+			return n, fmt.Errorf("timed out waiting for the client to acknowledge block %d", uint16(first+1))
+		}
+		s.wait(attempt - 1)
+	}
+}
+
+// readAck waits for an ACK that acknowledges at least one sent datagram, it returns the
+// number acknowledged as counted by acked, or 0 when the timeout passes first.
+func (s *windowSender) readAck(acked func(block uint16) int) (int, error) {
+	if err := s.conn.SetReadDeadline(time.Now().Add(s.timeout)); err != nil {
+		return 0, err
+	}
+	for {
+		n, err := s.conn.Read(s.buf)
+		if err != nil {
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				return 0, nil
+			}
+			return 0, err
+		}
+		if n < 4 {
+			continue
+		}
+		switch binary.BigEndian.Uint16(s.buf) {
+		case tftpAck:
+			if a := acked(binary.BigEndian.Uint16(s.buf[2:])); a > 0 {
+				s.datagramsAcked += a
+				return a, nil
+			}
+		case tftpError:
+			s.conn.Close()
+			s.conn = nil
+			return 0, fmt.Errorf("client error: code=%d, message: %s", binary.BigEndian.Uint16(s.buf[2:]), bytes.TrimRight(s.buf[4:n], "\x00"))
+		}
+	}
+}
+
+func (s *windowSender) write(p []byte) error {
+	if _, err := s.conn.Write(p); err != nil {
+		return err
+	}
+	s.datagramsSent++
+	return nil
+}
+
+// wait sleeps for the backoff of a retransmission attempt, pin/tftp's random duration of up to a second by default.
+func (s *windowSender) wait(attempt int) {
+	if s.backoff == nil {
+		time.Sleep(time.Duration(rand.Int63n(int64(time.Second))))
+		return
+	}
+	time.Sleep(s.backoff(attempt))
+}
+
+func (s *windowSender) stats() tftp.TransferStats {
+	return tftp.TransferStats{
+		RemoteAddr:     s.addr.IP,
+		Filename:       s.filename,
+		Tid:            s.addr.Port,
+		Mode:           s.mode,
+		Opts:           s.opts,
+		Duration:       time.Since(s.start),
+		DatagramsSent:  s.datagramsSent,
+		DatagramsAcked: s.datagramsAcked,
+	}
+}
+
+// abort ends the transfer with an error, which is sent to the client unless it sent one.
+func (s *windowSender) abort(err error) {
+	if s.done {
+		return
+	}
+	s.done = true
+	if s.hook != nil {
+		s.hook.OnFailure(s.stats(), err)
+	}
+	if s.conn == nil {
+		return
+	}
+	code := uint16(tftpErrUndefined)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		code = tftpErrFileNotFound
+	case errors.Is(err, os.ErrPermission):
+		code = tftpErrAccess
+	}
+	p := []byte{0, tftpError, byte(code >> 8), byte(code)}
+	p = append(p, err.Error()...)
+	_, _ = s.conn.Write(append(p, 0))
+	s.close()
+}
+
+func (s *windowSender) close() {
+	if s.conn != nil {
+		s.conn.Close()
+		s.conn = nil
+	}
+}
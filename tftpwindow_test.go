@@ -0,0 +1,263 @@
+package ipxe
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/google/go-cmp/cmp"
+	"github.com/pin/tftp"
+)
+
+// serveTestTFTP serves files over TFTP on a loopback address the way Config.Serve does, it returns the address.
+func serveTestTFTP(tb testing.TB, files FileSource, cfg TFTP) string {
+	tb.Helper()
+	return serveTestTFTPHandler(tb, HandleTFTP{Log: logr.Discard(), Files: files}, cfg)
+}
+
+// serveTestTFTPHandler is serveTestTFTP serving with h.
+func serveTestTFTPHandler(tb testing.TB, h HandleTFTP, cfg TFTP) string {
+	tb.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	if h.Hook == nil {
+		h.Hook = &TFTPHook{}
+	}
+	s := tftp.NewServer(h.ReadHandler, h.WriteHandler)
+	s.SetHook(h.Hook)
+	cfg.configure(s)
+	var pc net.PacketConn = conn
+	var ws *windowServer
+	if cfg.windowed() {
+		ws = newWindowServer(conn, h.ReadHandler, h.Hook, cfg, h.Log)
+		pc = ws
+	}
+	served := make(chan struct{})
+	go func() {
+		defer close(served)
+		_ = ServeTFTP(context.Background(), pc, s)
+	}()
+	tb.Cleanup(func() {
+		shutdownTFTP(s, pc, h.Hook, served)
+		if ws != nil {
+			ws.wait()
+		}
+	})
+	return conn.LocalAddr().String()
+}
+
+// tftpGet reads filename from the TFTP server at addr, requesting opts. It acknowledges
+// every window of blocks, or the last block received in order when a block is missing.
+// The block numbered drop is dropped the first time it is received. It returns the file
+// and the options acknowledged by the server.
+func tftpGet(addr, filename string, opts map[string]string, drop int) ([]byte, map[string]string, error) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		return nil, nil, err
+	}
+	defer conn.Close()
+	server, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, nil, err
+	}
+	rrq := []byte{0, tftpRRQ}
+	rrq = append(append(rrq, filename...), 0)
+	rrq = append(append(rrq, "octet"...), 0)
+	for name, value := range opts {
+		rrq = append(append(rrq, name...), 0)
+		rrq = append(append(rrq, value...), 0)
+	}
+	if _, err := conn.WriteTo(rrq, server); err != nil {
+		return nil, nil, err
+	}
+
+	var (
+		data     bytes.Buffer
+		oack     = map[string]string{}
+		blksize  = tftpBlockSize
+		window   = 1
+		last     uint16
+		received int
+		gapAcked bool
+		dropped  bool
+		buf      = make([]byte, tftpMaxBlockSize+4)
+	)
+	ack := func(block uint16) error {
+		p := make([]byte, 4)
+		binary.BigEndian.PutUint16(p, tftpAck)
+		binary.BigEndian.PutUint16(p[2:], block)
+		_, err := conn.WriteTo(p, server)
+		received = 0
+		return err
+	}
+	for {
+		if err := conn.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+			return nil, nil, err
+		}
+		n, from, err := conn.ReadFrom(buf)
+		if err != nil {
+			return nil, nil, err
+		}
+		server = from.(*net.UDPAddr)
+		switch binary.BigEndian.Uint16(buf) {
+		case tftpOACK:
+			fields := bytes.Split(buf[2:n-1], []byte{0})
+			for i := 0; i+1 < len(fields); i += 2 {
+				oack[string(fields[i])] = string(fields[i+1])
+			}
+			if v, ok := oack["blksize"]; ok {
+				blksize, _ = strconv.Atoi(v)
+			}
+			if v, ok := oack["windowsize"]; ok {
+				window, _ = strconv.Atoi(v)
+			}
+			if err := ack(0); err != nil {
+				return nil, nil, err
+			}
+		case tftpData:
+			block := binary.BigEndian.Uint16(buf[2:])
+			if int(block) == drop && !dropped {
+				dropped = true
+				continue
+			}
+			if block != last+1 {
+				if !gapAcked {
+					gapAcked = true
+					if err := ack(last); err != nil {
+						return nil, nil, err
+					}
+				}
+				continue
+			}
+			gapAcked = false
+			last = block
+			received++
+			data.Write(buf[4:n])
+			if n-4 < blksize {
+				return data.Bytes(), oack, ack(block)
+			}
+			if received == window {
+				if err := ack(block); err != nil {
+					return nil, nil, err
+				}
+			}
+		case tftpError:
+			return nil, nil, fmt.Errorf("code=%d, message: %s", binary.BigEndian.Uint16(buf[2:]), buf[4:n-1])
+		}
+	}
+}
+
+func TestWindowServer(t *testing.T) {
+	content := func(size int) []byte {
+		b := make([]byte, size)
+		for i := range b {
+			b[i] = byte(i % 251)
+		}
+		return b
+	}
+	tests := []struct {
+		name     string
+		size     int
+		opts     map[string]string
+		drop     int
+		wantOpts map[string]string
+	}{
+		{name: "lock-step", size: 3000, wantOpts: map[string]string{}},
+		{name: "windowed", size: 100000, opts: map[string]string{"blksize": "1024", "windowsize": "8"}, wantOpts: map[string]string{"blksize": "1024", "windowsize": "8"}},
+		{name: "window limited by the server", size: 10000, opts: map[string]string{"windowsize": "64"}, wantOpts: map[string]string{"windowsize": "16"}},
+		{name: "block size limited by the server", size: 10000, opts: map[string]string{"blksize": "8192"}, wantOpts: map[string]string{"blksize": "4096"}},
+		{name: "transfer size", size: 10000, opts: map[string]string{"tsize": "0", "windowsize": "4"}, wantOpts: map[string]string{"tsize": "10000", "windowsize": "4"}},
+		{name: "multiple of the block size", size: 4096, opts: map[string]string{"windowsize": "4"}, wantOpts: map[string]string{"windowsize": "4"}},
+		{name: "empty file", size: 0, opts: map[string]string{"windowsize": "4"}, wantOpts: map[string]string{"windowsize": "4"}},
+		{name: "dropped block", size: 10000, opts: map[string]string{"windowsize": "8"}, drop: 3, wantOpts: map[string]string{"windowsize": "8"}},
+		{name: "dropped last block of a window", size: 10000, opts: map[string]string{"windowsize": "4"}, drop: 4, wantOpts: map[string]string{"windowsize": "4"}},
+		{name: "lock-step dropped block", size: 3000, drop: 2, wantOpts: map[string]string{}},
+		{name: "block number rollover", size: 8 * 70000, opts: map[string]string{"blksize": "8", "windowsize": "16"}, wantOpts: map[string]string{"blksize": "8", "windowsize": "16"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			want := content(tt.size)
+			addr := serveTestTFTP(t, MapSource{"ipxe.efi": want}, TFTP{
+				Timeout:    100 * time.Millisecond,
+				Backoff:    ConstantBackoff(0),
+				BlockSize:  4096,
+				WindowSize: 16,
+			})
+			got, opts, err := tftpGet(addr, "ipxe.efi", tt.opts, tt.drop)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Fatalf("got %v bytes, want %v bytes", len(got), len(want))
+			}
+			if diff := cmp.Diff(opts, tt.wantOpts); diff != "" {
+				t.Fatal(diff)
+			}
+		})
+	}
+}
+
+func TestWindowServer_NotFound(t *testing.T) {
+	addr := serveTestTFTP(t, MapSource{}, TFTP{WindowSize: 16})
+	_, _, err := tftpGet(addr, "missing.efi", map[string]string{"windowsize": "16"}, 0)
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	if diff := cmp.Diff(err.Error()[:6], "code=1"); diff != "" {
+		t.Fatal(diff)
+	}
+}
+
+func TestWindowServer_Netascii(t *testing.T) {
+	// netascii read requests are passed on to pin/tftp.
+	addr := serveTestTFTP(t, MapSource{"auto.ipxe": []byte("#!ipxe\n")}, TFTP{WindowSize: 16})
+	c, err := tftp.NewClient(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wt, err := c.Receive("auto.ipxe", "netascii")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if _, err := wt.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(buf.String(), "#!ipxe\n"); diff != "" {
+		t.Fatal(diff)
+	}
+}
+
+func TestParseTFTPRequest(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      []byte
+		want    tftpRequest
+		wantErr bool
+	}{
+		{name: "no options", in: []byte("\x00\x01ipxe.efi\x00octet\x00"), want: tftpRequest{filename: "ipxe.efi", mode: "octet", opts: map[string]string{}}},
+		{name: "options", in: []byte("\x00\x01ipxe.efi\x00octet\x00BLKSIZE\x001432\x00windowsize\x0016\x00"), want: tftpRequest{filename: "ipxe.efi", mode: "octet", opts: map[string]string{"blksize": "1432", "windowsize": "16"}}},
+		{name: "write request", in: []byte("\x00\x02ipxe.efi\x00octet\x00"), wantErr: true},
+		{name: "missing mode", in: []byte("\x00\x01ipxe.efi\x00"), wantErr: true},
+		{name: "not terminated", in: []byte("\x00\x01ipxe.efi\x00octet"), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseTFTPRequest(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got err: %v, wantErr: %v", err, tt.wantErr)
+			}
+			if diff := cmp.Diff(got, tt.want, cmp.AllowUnexported(tftpRequest{})); diff != "" {
+				t.Fatal(diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,236 @@
+package ipxe
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+
+	"inet.af/netaddr"
+)
+
+// maxUploadNameLen is the longest file name an upload is stored with.
+const maxUploadNameLen = 255
+
+// unsafeUploadChars are the characters replaced in the names of uploaded files.
+var unsafeUploadChars = regexp.MustCompile(`[^A-Za-z0-9._-]`)
+
+// ErrQuotaExceeded is wrapped by the errors returned when an upload is larger than allowed.
+var ErrQuotaExceeded = fmt.Errorf("upload quota exceeded: %w", os.ErrPermission)
+
+// Uploads is the configuration for accepting files uploaded with TFTP write requests.
+//
+// Files are written to a subdirectory of Dir per client, named after the MAC address when
+// the filename is prefixed with one, like reads, and after the client IP otherwise.
+// The MAC address is chosen by the client, nothing stops a client from writing to the directory
+// of another machine, or from spreading its uploads over many directories to get around Quota.
+// Use Pattern and an ACL to restrict uploads when clients are not trusted.
+// An upload is written to a temporary file first and only renamed to its final name once complete.
+type Uploads struct {
+	// Dir is the directory uploads are written to. It must exist.
+	Dir string
+	// MaxSize is the maximum size of a single upload in bytes, 0 means no limit.
+	MaxSize int64
+	// Quota is the maximum total size in bytes of the files in the directory of a client, 0 means no limit.
+	// An upload reserves its size from the quota when it starts, or the rest of the quota when the
+	// client did not send its size, until it completes.
+	Quota int64
+	// Pattern, when set, must match the sanitised filename of an upload for it to be accepted.
+	Pattern *regexp.Regexp
+	// OnUpload, when set, is called with every file received, after it has been written to Dir.
+	OnUpload func(Upload)
+
+	// mu serialises the quota check and rename of uploads.
+	mu sync.Mutex
+	// reserved is the quota reserved by the uploads in progress, by client directory.
+	reserved map[string]int64
+}
+
+// Upload is a file received from a client.
+type Upload struct {
+	// Client is the IP of the client that uploaded the file.
+	Client netaddr.IP
+	// MAC is the MAC address the filename was prefixed with, nil when it was not.
+	MAC net.HardwareAddr
+	// Name is the sanitised filename.
+	Name string
+	// Path is where the file was written.
+	Path string
+	// Size is the length of the file in bytes.
+	Size int64
+}
+
+// SanitizeUploadName returns the name an uploaded file is stored with, the base of filename
+// with every character other than letters, digits, '.', '_' and '-' replaced with '_' and
+// without leading dots. It returns an error when nothing is left.
+func SanitizeUploadName(filename string) (string, error) {
+	name := path.Base(strings.ReplaceAll(filename, `\`, "/"))
+	if name == "/" {
+		name = ""
+	}
+	name = unsafeUploadChars.ReplaceAllString(name, "_")
+	name = strings.TrimLeft(name, ".")
+	if len(name) > maxUploadNameLen {
+		name = name[:maxUploadNameLen]
+	}
+	if name == "" {
+		return "", fmt.Errorf("invalid upload filename %q: %w", filename, os.ErrPermission)
+	}
+	return name, nil
+}
+
+// clientDir returns the directory the uploads of a client are written to.
+func (u *Uploads) clientDir(mac net.HardwareAddr, ip netaddr.IP) string {
+	name := strings.ReplaceAll(ip.String(), ":", "-")
+	if mac != nil {
+		name = strings.ReplaceAll(mac.String(), ":", "-")
+	}
+	return filepath.Join(u.Dir, name)
+}
+
+// used returns the total size of the files in dir.
+func used(dir string) (int64, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	var n int64
+	for _, info := range infos {
+		if info.Mode().IsRegular() {
+			n += info.Size()
+		}
+	}
+	return n, nil
+}
+
+// limit returns the largest size an upload to dir can be, -1 means no limit. u.mu must be held.
+func (u *Uploads) limit(dir string) (int64, error) {
+	limit := int64(-1)
+	if u.MaxSize > 0 {
+		limit = u.MaxSize
+	}
+	if u.Quota > 0 {
+		n, err := used(dir)
+		if err != nil {
+			return 0, err
+		}
+		left := u.Quota - n - u.reserved[dir]
+		if left < 0 {
+			left = 0
+		}
+		if limit < 0 || left < limit {
+			limit = left
+		}
+	}
+	return limit, nil
+}
+
+// reserve reserves the quota of dir for an upload of size bytes, or of as many bytes as are left
+// when the size is unknown. It returns the largest size the upload can be, -1 means no limit,
+// and the number of bytes reserved, which must be given back with unreserve.
+func (u *Uploads) reserve(dir string, size int64, sizeKnown bool) (limit, reserved int64, err error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if limit, err = u.limit(dir); err != nil {
+		return 0, 0, err
+	}
+	if limit >= 0 && sizeKnown && size > limit {
+		return 0, 0, fmt.Errorf("upload of %v bytes, %v left: %w", size, limit, ErrQuotaExceeded)
+	}
+	if u.Quota <= 0 {
+		return limit, 0, nil
+	}
+	// a client sending more than it announced is stopped at the reserved size.
+	if sizeKnown {
+		limit = size
+	}
+	if u.reserved == nil {
+		u.reserved = make(map[string]int64)
+	}
+	u.reserved[dir] += limit
+	return limit, limit, nil
+}
+
+// unreserve gives back n bytes reserved from the quota of dir. u.mu must be held.
+func (u *Uploads) unreserve(dir string, n int64) {
+	if n == 0 {
+		return
+	}
+	u.reserved[dir] -= n
+	if u.reserved[dir] <= 0 {
+		delete(u.reserved, dir)
+	}
+}
+
+// receive writes the file from wt to the directory of the client, as name.
+func (u *Uploads) receive(wt io.WriterTo, size int64, sizeKnown bool, name string, mac net.HardwareAddr, ip netaddr.IP) (Upload, error) {
+	if u.Pattern != nil && !u.Pattern.MatchString(name) {
+		return Upload{}, fmt.Errorf("upload filename %q does not match %v: %w", name, u.Pattern, os.ErrPermission)
+	}
+	dir := u.clientDir(mac, ip)
+	limit, reserved, err := u.reserve(dir, size, sizeKnown)
+	if err != nil {
+		return Upload{}, err
+	}
+	defer func() {
+		u.mu.Lock()
+		u.unreserve(dir, reserved)
+		u.mu.Unlock()
+	}()
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return Upload{}, err
+	}
+	// the temporary file starts with a dot, no uploaded file does.
+	tmp, err := ioutil.TempFile(dir, "."+name+".*.part")
+	if err != nil {
+		return Upload{}, err
+	}
+	defer os.Remove(tmp.Name())
+	n, err := wt.WriteTo(&limitedWriter{w: tmp, limit: limit})
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return Upload{}, err
+	}
+
+	up := Upload{Client: ip, MAC: mac, Name: name, Path: filepath.Join(dir, name), Size: n}
+	// the reservation is given back together with the rename, so the upload is always counted.
+	u.mu.Lock()
+	err = os.Rename(tmp.Name(), up.Path)
+	u.unreserve(dir, reserved)
+	reserved = 0
+	u.mu.Unlock()
+	if err != nil {
+		return Upload{}, err
+	}
+	if u.OnUpload != nil {
+		u.OnUpload(up)
+	}
+	return up, nil
+}
+
+// limitedWriter is an io.Writer that fails once more than limit bytes are written, a negative limit means no limit.
+type limitedWriter struct {
+	w     io.Writer
+	limit int64
+	n     int64
+}
+
+func (l *limitedWriter) Write(p []byte) (int, error) {
+	if l.limit >= 0 && l.n+int64(len(p)) > l.limit {
+		return 0, fmt.Errorf("upload larger than %v bytes: %w", l.limit, ErrQuotaExceeded)
+	}
+	n, err := l.w.Write(p)
+	l.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,259 @@
+package ipxe
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+
+	"github.com/go-logr/logr"
+	"github.com/google/go-cmp/cmp"
+	"github.com/pin/tftp"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"inet.af/netaddr"
+)
+
+func TestSanitizeUploadName(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    string
+		wantErr bool
+	}{
+		{in: "crash.log", want: "crash.log"},
+		{in: "aa:bb:cc:dd:ee:ff/inventory.json", want: "inventory.json"},
+		{in: "../../etc/passwd", want: "passwd"},
+		{in: `..\..\boot.ini`, want: "boot.ini"},
+		{in: ".hidden", want: "hidden"},
+		{in: "console capture$(1).txt", want: "console_capture__1_.txt"},
+		{in: "..", wantErr: true},
+		{in: "/", wantErr: true},
+		{in: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := SanitizeUploadName(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got err: %v, wantErr: %v", err, tt.wantErr)
+			}
+			if diff := cmp.Diff(got, tt.want); diff != "" {
+				t.Fatal(diff)
+			}
+		})
+	}
+}
+
+// fakeWriterTo is an io.WriterTo and tftp.IncomingTransfer of content.
+type fakeWriterTo struct {
+	content []byte
+	tsize   bool
+}
+
+func (f fakeWriterTo) WriteTo(w io.Writer) (int64, error) {
+	return io.Copy(w, bytes.NewReader(f.content))
+}
+
+func (f fakeWriterTo) Size() (int64, bool) { return int64(len(f.content)), f.tsize }
+
+func (f fakeWriterTo) RemoteAddr() net.UDPAddr {
+	return net.UDPAddr{IP: net.IPv4(192, 168, 2, 34), Port: 9999}
+}
+
+func TestHandleTFTP_WriteHandlerUploads(t *testing.T) {
+	tests := []struct {
+		name     string
+		filename string
+		content  []byte
+		tsize    bool
+		existing int
+		wantPath string
+		wantErr  error
+	}{
+		{name: "by ip", filename: "crash.log", content: []byte("oops"), wantPath: "192.168.2.34/crash.log"},
+		{name: "by mac", filename: "aa:bb:cc:dd:ee:ff/inventory.json", content: []byte("{}"), wantPath: "aa-bb-cc-dd-ee-ff/inventory.json"},
+		{name: "pattern", filename: "ipxe.efi", content: []byte("MZ"), wantErr: os.ErrPermission},
+		{name: "max size", filename: "big.log", content: make([]byte, 101), wantErr: ErrQuotaExceeded},
+		{name: "max size from tsize", filename: "big.log", content: make([]byte, 101), tsize: true, wantErr: ErrQuotaExceeded},
+		{name: "quota", filename: "more.log", content: make([]byte, 60), existing: 200, wantErr: ErrQuotaExceeded},
+		{name: "within quota", filename: "more.log", content: make([]byte, 40), existing: 200, wantPath: "192.168.2.34/more.log"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			if tt.existing > 0 {
+				if err := os.MkdirAll(filepath.Join(dir, "192.168.2.34"), 0o755); err != nil {
+					t.Fatal(err)
+				}
+				if err := ioutil.WriteFile(filepath.Join(dir, "192.168.2.34", "old.log"), make([]byte, tt.existing), 0o600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			var got []Upload
+			h := HandleTFTP{Log: logr.Discard(), Uploads: &Uploads{
+				Dir:      dir,
+				MaxSize:  100,
+				Quota:    250,
+				Pattern:  regexp.MustCompile(`\.(log|json)$`),
+				OnUpload: func(u Upload) { got = append(got, u) },
+			}}
+			err := h.WriteHandler(tt.filename, fakeWriterTo{content: tt.content, tsize: tt.tsize})
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got err: %v, want: %v", err, tt.wantErr)
+			}
+			if tt.wantErr != nil {
+				if len(got) != 0 {
+					t.Fatal("expected OnUpload not to be called")
+				}
+				// only the existing file is left behind.
+				infos, _ := ioutil.ReadDir(filepath.Join(dir, "192.168.2.34"))
+				for _, info := range infos {
+					if info.Name() != "old.log" {
+						t.Fatalf("expected %v to be removed", info.Name())
+					}
+				}
+				return
+			}
+			content, err := ioutil.ReadFile(filepath.Join(dir, tt.wantPath))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(content, tt.content); diff != "" {
+				t.Fatal(diff)
+			}
+			if len(got) != 1 {
+				t.Fatalf("got %v calls to OnUpload, want 1", len(got))
+			}
+			if diff := cmp.Diff(got[0].Path, filepath.Join(dir, tt.wantPath)); diff != "" {
+				t.Fatal(diff)
+			}
+			if diff := cmp.Diff(got[0].Size, int64(len(tt.content))); diff != "" {
+				t.Fatal(diff)
+			}
+			if got[0].Client != netaddr.MustParseIP("192.168.2.34") {
+				t.Fatalf("got client %v, want 192.168.2.34", got[0].Client)
+			}
+		})
+	}
+}
+
+func TestHandleTFTP_WriteHandlerMetrics(t *testing.T) {
+	ok := testutil.ToFloat64(requestsTotal.WithLabelValues(protocolTFTP, "", outcomeOK))
+	failed := testutil.ToFloat64(requestsTotal.WithLabelValues(protocolTFTP, "", outcomeError))
+	denied := testutil.ToFloat64(deniedTotal.WithLabelValues(protocolTFTP))
+
+	h := HandleTFTP{Log: logr.Discard(), Uploads: &Uploads{Dir: t.TempDir(), Pattern: regexp.MustCompile(`\.log$`)}}
+	if err := h.WriteHandler("crash.log", fakeWriterTo{content: []byte("oops")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.WriteHandler("ipxe.efi", fakeWriterTo{content: []byte("MZ")}); !errors.Is(err, os.ErrPermission) {
+		t.Fatalf("got err: %v, want: %v", err, os.ErrPermission)
+	}
+	deny, err := ParseIPSet([]string{"192.168.2.0/24"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.ACL = &ACL{Deny: deny}
+	if err := h.WriteHandler("crash.log", fakeWriterTo{content: []byte("oops")}); err == nil {
+		t.Fatal("expected the upload to be denied")
+	}
+
+	if got := testutil.ToFloat64(requestsTotal.WithLabelValues(protocolTFTP, "", outcomeOK)) - ok; got != 1 {
+		t.Fatalf("uploads, got: %v, want: 1", got)
+	}
+	if got := testutil.ToFloat64(requestsTotal.WithLabelValues(protocolTFTP, "", outcomeError)) - failed; got != 1 {
+		t.Fatalf("failed uploads, got: %v, want: 1", got)
+	}
+	if got := testutil.ToFloat64(deniedTotal.WithLabelValues(protocolTFTP)) - denied; got != 1 {
+		t.Fatalf("denied uploads, got: %v, want: 1", got)
+	}
+}
+
+// blockingWriterTo is an io.WriterTo that writes content once release is closed.
+type blockingWriterTo struct {
+	fakeWriterTo
+	started chan struct{}
+	release chan struct{}
+}
+
+func (b blockingWriterTo) WriteTo(w io.Writer) (int64, error) {
+	close(b.started)
+	<-b.release
+	return b.fakeWriterTo.WriteTo(w)
+}
+
+func TestHandleTFTP_WriteHandlerConcurrentQuota(t *testing.T) {
+	for _, tsize := range []bool{true, false} {
+		t.Run(fmt.Sprintf("tsize %v", tsize), func(t *testing.T) {
+			dir := t.TempDir()
+			h := HandleTFTP{Log: logr.Discard(), Uploads: &Uploads{Dir: dir, Quota: 100}}
+			first := blockingWriterTo{fakeWriterTo: fakeWriterTo{content: make([]byte, 60), tsize: tsize}, started: make(chan struct{}), release: make(chan struct{})}
+			errCh := make(chan error, 1)
+			go func() { errCh <- h.WriteHandler("first.log", first) }()
+			<-first.started
+
+			if err := h.WriteHandler("second.log", fakeWriterTo{content: make([]byte, 60), tsize: tsize}); !errors.Is(err, ErrQuotaExceeded) {
+				t.Fatalf("got err: %v, want: %v", err, ErrQuotaExceeded)
+			}
+			close(first.release)
+			if err := <-errCh; err != nil {
+				t.Fatal(err)
+			}
+			if n, err := used(filepath.Join(dir, "192.168.2.34")); err != nil || n != 60 {
+				t.Fatalf("got %v bytes uploaded, err: %v, want: 60", n, err)
+			}
+			// the reservation is given back once the upload completes.
+			if err := h.WriteHandler("third.log", fakeWriterTo{content: make([]byte, 40), tsize: tsize}); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestConfig_ServeTFTPUploads(t *testing.T) {
+	dir := t.TempDir()
+	received := make(chan Upload, 1)
+	c := Config{
+		TFTP: TFTP{Addr: freeAddr(t, "udp"), Uploads: &Uploads{Dir: dir, OnUpload: func(u Upload) { received <- u }}},
+		HTTP: HTTP{Addr: freeAddr(t, "tcp")},
+		Log:  logr.Discard(),
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	errCh := make(chan error, 1)
+	go func() { errCh <- c.Serve(ctx) }()
+	defer func() {
+		cancel()
+		<-errCh
+	}()
+
+	client, err := tftp.NewClient(c.TFTP.Addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := bytes.Repeat([]byte("console output\n"), 100)
+	var rf io.ReaderFrom
+	for i := 0; i < 100; i++ {
+		if rf, err = client.Send("console.txt", "octet"); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rf.ReadFrom(bytes.NewReader(content)); err != nil {
+		t.Fatal(err)
+	}
+	u := <-received
+	got, err := ioutil.ReadFile(u.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(got, content); diff != "" {
+		t.Fatal(diff)
+	}
+}
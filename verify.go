@@ -0,0 +1,133 @@
+package ipxe
+
+import (
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/go-logr/logr"
+)
+
+// ErrChecksumMismatch is returned when a file does not match its expected checksum.
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+
+// VerifyMode controls what happens when a file does not match its expected checksum.
+type VerifyMode int
+
+const (
+	// VerifyEnforce refuses to serve files that do not match their expected checksum.
+	// Config.Serve will not start.
+	VerifyEnforce VerifyMode = iota
+	// VerifyWarn logs files that do not match their expected checksum and serves them anyway.
+	VerifyWarn
+	// VerifyOff disables checksum verification.
+	VerifyOff
+)
+
+var verifyModes = map[VerifyMode]string{
+	VerifyEnforce: "enforce",
+	VerifyWarn:    "warn",
+	VerifyOff:     "off",
+}
+
+// String returns the name of the mode.
+func (v VerifyMode) String() string {
+	if s, ok := verifyModes[v]; ok {
+		return s
+	}
+	return fmt.Sprintf("VerifyMode(%d)", int(v))
+}
+
+// ParseVerifyMode parses "enforce", "warn" or "off" into a VerifyMode.
+func ParseVerifyMode(s string) (VerifyMode, error) {
+	for v, name := range verifyModes {
+		if strings.EqualFold(s, name) {
+			return v, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown verify mode %q, must be one of enforce, warn or off", s)
+}
+
+// Checksums are expected hex encoded SHA-512 digests of files, by file name.
+// binary.ParseChecksums reads them from the output of sha512sum.
+type Checksums map[string]string
+
+// Verify returns the hex encoded SHA-512 digest of content. The returned error wraps
+// ErrChecksumMismatch when the digest does not match the expected digest for name.
+// Files without an expected digest always pass.
+func (c Checksums) Verify(name string, content []byte) (string, error) {
+	sum := sha512.Sum512(content)
+	got := hex.EncodeToString(sum[:])
+	if want, ok := c[name]; ok && !strings.EqualFold(want, got) {
+		return got, fmt.Errorf("%q: %w: got sha512 %v, want %v", name, ErrChecksumMismatch, got, want)
+	}
+	return got, nil
+}
+
+// FileLister is implemented by a FileSource that can list the files it serves.
+type FileLister interface {
+	// List returns the names of all files that can be opened.
+	List() ([]string, error)
+}
+
+func errNotLister(fs FileSource) error {
+	return fmt.Errorf("%T does not implement FileLister", fs)
+}
+
+// List implements FileLister.
+func (m MapSource) List() ([]string, error) {
+	names := make([]string, 0, len(m))
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// verifyFiles checks the named files in fs against sums, logging the digest of each one.
+// With VerifyEnforce the first mismatch is returned, with VerifyWarn mismatches are only logged.
+func verifyFiles(fs FileSource, names []string, sums Checksums, mode VerifyMode, log logr.Logger) error {
+	if mode == VerifyOff {
+		return nil
+	}
+	for _, name := range names {
+		f, err := fs.Open(name)
+		if err != nil {
+			return err
+		}
+		content, err := io.ReadAll(f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+		if err := verifyContent(name, content, sums, mode, log); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// verifyContent checks content against the expected digest for name in sums, logging its digest.
+func verifyContent(name string, content []byte, sums Checksums, mode VerifyMode, log logr.Logger) error {
+	if mode == VerifyOff {
+		return nil
+	}
+	log = orDiscard(log)
+	digest, err := sums.Verify(name, content)
+	switch {
+	case err != nil && mode == VerifyEnforce:
+		log.Error(err, "file failed verification", "file", name, "sha512", digest)
+		return err
+	case err != nil:
+		log.Error(err, "file failed verification, serving it anyway", "file", name, "sha512", digest)
+	case sums[name] == "":
+		log.Info("file has no expected checksum", "file", name, "sha512", digest)
+	default:
+		log.Info("file verified", "file", name, "sha512", digest)
+	}
+	return nil
+}
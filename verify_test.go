@@ -0,0 +1,95 @@
+package ipxe
+
+import (
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-logr/logr"
+	"github.com/google/go-cmp/cmp"
+	"github.com/jacobweinstock/ipxe/binary"
+)
+
+func sha512Hex(b []byte) string {
+	sum := sha512.Sum512(b)
+	return hex.EncodeToString(sum[:])
+}
+
+func TestVerifyFiles(t *testing.T) {
+	src := MapSource{"good.efi": []byte("good"), "bad.efi": []byte("bad"), "unknown.efi": []byte("unknown")}
+	sums := Checksums{"good.efi": sha512Hex([]byte("good")), "bad.efi": sha512Hex([]byte("not bad"))}
+	tests := []struct {
+		name    string
+		files   []string
+		mode    VerifyMode
+		wantErr error
+	}{
+		{name: "match", files: []string{"good.efi", "unknown.efi"}, mode: VerifyEnforce},
+		{name: "mismatch enforced", files: []string{"good.efi", "bad.efi"}, mode: VerifyEnforce, wantErr: ErrChecksumMismatch},
+		{name: "mismatch warned", files: []string{"good.efi", "bad.efi"}, mode: VerifyWarn},
+		{name: "off", files: []string{"bad.efi"}, mode: VerifyOff},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := verifyFiles(src, tt.files, sums, tt.mode, logr.Discard())
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("error mismatch, got: %v, want: %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestVerifyFiles_Embedded(t *testing.T) {
+	if err := verifyFiles(EmbeddedSource(), sortedNames(binary.Files), Checksums(binary.Checksums), VerifyEnforce, logr.Discard()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestParseVerifyMode(t *testing.T) {
+	for _, want := range []VerifyMode{VerifyEnforce, VerifyWarn, VerifyOff} {
+		got, err := ParseVerifyMode(want.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Fatalf("got: %v, want: %v", got, want)
+		}
+	}
+	if _, err := ParseVerifyMode("sometimes"); err == nil {
+		t.Fatal("expected error for unknown mode")
+	}
+}
+
+func TestDirSource_ScanVerify(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "ipxe.efi")
+	if err := ioutil.WriteFile(name, []byte("v1"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	d := &DirSource{Dir: dir, Checksums: Checksums{"ipxe.efi": sha512Hex([]byte("v1"))}}
+	if err := d.Scan(); err != nil {
+		t.Fatal(err)
+	}
+
+	// a file that fails verification is not loaded and the verified one keeps being served.
+	if err := ioutil.WriteFile(name, []byte("tampered"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Scan(); err != nil {
+		t.Fatal(err)
+	}
+	f, err := d.Open("ipxe.efi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(string(got), "v1"); diff != "" {
+		t.Fatal(diff)
+	}
+}